@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminToken authenticates the /admin/ endpoints. When empty, they are disabled.
+var adminToken string
+
+// adminResult describes the outcome of an admin operation on one database.
+type adminResult struct {
+	Database      string  `json:"database"`
+	OldBuildEpoch uint    `json:"old_build_epoch"`
+	NewBuildEpoch uint    `json:"new_build_epoch"`
+	OldType       string  `json:"old_type,omitempty"`
+	NewType       string  `json:"new_type,omitempty"`
+	Changed       bool    `json:"changed"`
+	DurationMs    float64 `json:"duration_ms"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// requireAdmin wraps an admin handler with bearer token authentication and a
+// method check. The token may be sent as "Authorization: Bearer
+// <token>" or in the X-Admin-Token header.
+func requireAdmin(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin API disabled (set ADMIN_TOKEN to enable it)", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="geoip-api admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// GET endpoints answer HEAD as well, as net/http does
+		if r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+			w.Header().Set("Allow", method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// adminTargets returns the databases selected by ?database=name. When it is
+// omitted, all databases are selected for which eligible, if not nil, is true.
+func adminTargets(r *http.Request, eligible func(*databaseEntry) bool) ([]*databaseEntry, error) {
+	name := r.URL.Query().Get("database")
+	if name == "" {
+		var entries []*databaseEntry
+		for _, entry := range registry.all() {
+			if eligible == nil || eligible(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}
+	entry := registry.get(name)
+	if entry == nil {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	return []*databaseEntry{entry}, nil
+}
+
+// runAdminOperation applies op to every targeted database (see adminTargets)
+// and writes the per-database results as JSON. The status is 200 when every
+// operation succeeded, 404 when a requested version does not exist and 500
+// otherwise.
+func runAdminOperation(w http.ResponseWriter, r *http.Request, action string, eligible func(*databaseEntry) bool, op func(*databaseEntry) error) {
+	targets, err := adminTargets(r, eligible)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Downloads can take longer than the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(httpTimeout + serverWriteTimeout)); err != nil {
+		logger.Error("failed to extend write deadline", "operation", action, "error", err)
+	}
+
+	status := http.StatusOK
+	results := make([]adminResult, 0, len(targets))
+	for _, entry := range targets {
+		result := adminResult{Database: entry.name}
+		result.OldBuildEpoch, result.OldType = entry.describe()
+
+		start := time.Now()
+		err := op(entry)
+		result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+
+		result.NewBuildEpoch, result.NewType = entry.describe()
+		result.Changed = result.NewBuildEpoch != result.OldBuildEpoch || result.NewType != result.OldType
+		switch {
+		case err == nil:
+		case errors.Is(err, errVersionNotFound):
+			result.Error = err.Error()
+			if status == http.StatusOK {
+				status = http.StatusNotFound
+			}
+		default:
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		logger.Info("admin "+action, "database", entry.name, "old_build_epoch", result.OldBuildEpoch, "new_build_epoch", result.NewBuildEpoch, "duration_ms", result.DurationMs, "error", result.Error)
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// adminReloadHandler reloads databases from disk.
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	runAdminOperation(w, r, "reload", nil, func(entry *databaseEntry) error {
+		entry.updateMu.Lock()
+		defer entry.updateMu.Unlock()
+		return reloadDatabase(entry)
+	})
+}
+
+// adminUpdateHandler checks for and installs newer builds immediately. With
+// ?force=true, databases are downloaded even when upstream has nothing new.
+// Without ?database=, databases that cannot be downloaded, because they have
+// no edition or the source is not configured, are skipped.
+func adminUpdateHandler(source downloadSource) http.HandlerFunc {
+	updatable := func(entry *databaseEntry) bool {
+		return entry.editionID != "" && source.configured() == nil
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		force := r.URL.Query().Get("force") == "true"
+		runAdminOperation(w, r, "update", updatable, func(entry *databaseEntry) error {
+			return updateDatabase(source, entry, force)
+		})
+	}
+}
+
+// adminRollbackHandler restores a kept version of the database named with
+// ?database=, either the one given with ?version=YYYYMMDD or the newest build
+// older than the loaded one.
+func adminRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("database") == "" {
+		http.Error(w, "Missing ?database= parameter", http.StatusBadRequest)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	runAdminOperation(w, r, "rollback", nil, func(entry *databaseEntry) error {
+		entry.updateMu.Lock()
+		defer entry.updateMu.Unlock()
+		_, err := rollbackDatabase(entry, version)
+		return err
+	})
+}
+
+// adminVersionsHandler lists the kept versions of every database (or the one
+// named with ?database=), newest build first.
+func adminVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	targets, err := adminTargets(r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	type databaseVersions struct {
+		Database         string            `json:"database"`
+		LoadedBuildEpoch uint              `json:"loaded_build_epoch"`
+		Versions         []databaseVersion `json:"versions"`
+	}
+	results := make([]databaseVersions, 0, len(targets))
+	for _, entry := range targets {
+		versions, err := listVersions(entry.path)
+		if err != nil {
+			logger.Error("failed to list database versions", "database", entry.name, "error", err)
+		}
+		if versions == nil {
+			versions = []databaseVersion{}
+		}
+		buildEpoch, _ := entry.describe()
+		results = append(results, databaseVersions{Database: entry.name, LoadedBuildEpoch: buildEpoch, Versions: versions})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
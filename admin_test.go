@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAdminUpdateTargets(t *testing.T) {
+	defer func(entries []*databaseEntry, token string) {
+		registry.entries, adminToken = entries, token
+	}(registry.entries, adminToken)
+	adminToken = "secret"
+
+	unconfigured := &httpSource{name: "MaxMind", unavailable: fmt.Errorf("%w: MAXMIND_LICENSE_KEY not set", errSourceUnavailable)}
+
+	tests := []struct {
+		name          string
+		source        downloadSource
+		query         string
+		wantStatus    int
+		wantDatabases []string
+		wantFailures  int
+	}{
+		{
+			name:          "unconfigured source skips every database",
+			source:        unconfigured,
+			wantStatus:    http.StatusOK,
+			wantDatabases: []string{},
+		},
+		{
+			name:          "unconfigured source for a named database",
+			source:        unconfigured,
+			query:         "?database=city",
+			wantStatus:    http.StatusInternalServerError,
+			wantDatabases: []string{"city"},
+		},
+		{
+			name:          "databases without an edition are skipped",
+			source:        &localSource{path: filepath.Join(t.TempDir(), "missing")},
+			wantStatus:    http.StatusInternalServerError,
+			wantDatabases: []string{"city"},
+			wantFailures:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			city := &databaseEntry{name: "city", path: filepath.Join(dir, "GeoLite2-City.mmdb"), editionID: "GeoLite2-City", updateInterval: 24}
+			custom := &databaseEntry{name: "custom", path: filepath.Join(dir, "custom.mmdb")}
+			registry.entries = []*databaseEntry{city, custom}
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/update"+tt.query, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			requireAdmin(http.MethodPost, adminUpdateHandler(tt.source))(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var results []adminResult
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatalf("invalid response %q: %v", w.Body, err)
+			}
+			databases := []string{}
+			for _, result := range results {
+				databases = append(databases, result.Database)
+			}
+			if !reflect.DeepEqual(databases, tt.wantDatabases) {
+				t.Errorf("databases = %v, want %v", databases, tt.wantDatabases)
+			}
+			if failures := city.Status().ConsecutiveFailures; failures != tt.wantFailures {
+				t.Errorf("ConsecutiveFailures = %d, want %d", failures, tt.wantFailures)
+			}
+		})
+	}
+}
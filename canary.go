@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// downloadCanary is an IP address with the values a downloaded database is
+// expected to return for it. Empty expectations are not checked.
+type downloadCanary struct {
+	IP      net.IP
+	Country string
+	ASN     uint
+	City    string
+}
+
+// defaultCanaries is the built-in verification set. Mismatches are only
+// logged, because a single IP says little about the quality of a build.
+var defaultCanaries = []downloadCanary{
+	{IP: net.ParseIP("8.8.8.8"), Country: "US", ASN: 15169}, // Google Public DNS
+}
+
+var (
+	// downloadCanaries is loaded from DB_CANARY_FILE. When set, downloaded
+	// databases are rejected if too many canaries changed.
+	downloadCanaries []downloadCanary
+
+	// canaryMaxChangedPercent is the share of canaries that may differ from
+	// their expectations before an update is rejected.
+	canaryMaxChangedPercent = 10.0
+)
+
+// loadCanaryFile reads canaries from a CSV file with the columns
+// ip,country,asn,city. Trailing columns may be omitted or left empty, and
+// lines starting with # are ignored.
+func loadCanaryFile(path string) ([]downloadCanary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var canaries []downloadCanary
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		canary := downloadCanary{IP: net.ParseIP(strings.TrimSpace(record[0]))}
+		if canary.IP == nil {
+			return nil, fmt.Errorf("line %d: invalid IP address %q", line, record[0])
+		}
+		if len(record) > 1 {
+			canary.Country = strings.ToUpper(strings.TrimSpace(record[1]))
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(record[2])), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid ASN %q", line, record[2])
+			}
+			canary.ASN = uint(asn)
+		}
+		if len(record) > 3 {
+			canary.City = strings.TrimSpace(record[3])
+		}
+		canaries = append(canaries, canary)
+	}
+
+	if len(canaries) == 0 {
+		return nil, fmt.Errorf("no canaries found")
+	}
+	return canaries, nil
+}
+
+// checkDownloadCanaries looks up the canaries applicable to a database of the
+// given kind. It returns the number of canaries checked and a description of
+// each one whose result differs from its expectations.
+func checkDownloadCanaries(db *databaseReader, kind databaseKind, canaries []downloadCanary) (int, []string) {
+	checked := 0
+	var changed []string
+	for _, canary := range canaries {
+		var got []string
+		switch kind {
+		case kindASN:
+			if canary.ASN == 0 {
+				continue
+			}
+			record, err := db.ASN(canary.IP)
+			if err != nil {
+				changed = append(changed, fmt.Sprintf("%s: %v", canary.IP, err))
+				checked++
+				continue
+			}
+			if record.AutonomousSystemNumber != canary.ASN {
+				got = append(got, fmt.Sprintf("ASN %d, expected %d", record.AutonomousSystemNumber, canary.ASN))
+			}
+		case kindCity:
+			if canary.Country == "" && canary.City == "" {
+				continue
+			}
+			record, err := db.City(canary.IP)
+			if err != nil {
+				changed = append(changed, fmt.Sprintf("%s: %v", canary.IP, err))
+				checked++
+				continue
+			}
+			if canary.Country != "" && record.Country.IsoCode != canary.Country {
+				got = append(got, fmt.Sprintf("country %q, expected %q", record.Country.IsoCode, canary.Country))
+			}
+			if canary.City != "" && !strings.EqualFold(record.City.Names["en"], canary.City) {
+				got = append(got, fmt.Sprintf("city %q, expected %q", record.City.Names["en"], canary.City))
+			}
+		case kindCountry:
+			if canary.Country == "" {
+				continue
+			}
+			record, err := db.Country(canary.IP)
+			if err != nil {
+				changed = append(changed, fmt.Sprintf("%s: %v", canary.IP, err))
+				checked++
+				continue
+			}
+			if record.Country.IsoCode != canary.Country {
+				got = append(got, fmt.Sprintf("country %q, expected %q", record.Country.IsoCode, canary.Country))
+			}
+		default:
+			return 0, nil
+		}
+
+		checked++
+		if len(got) > 0 {
+			changed = append(changed, fmt.Sprintf("%s: %s", canary.IP, strings.Join(got, ", ")))
+		}
+	}
+	return checked, changed
+}
+
+// verifyDownloadCanaries applies the canary policy to a downloaded database.
+// With a configured canary file it returns an error when more than
+// canaryMaxChangedPercent of the applicable canaries changed; the built-in
+// canaries only log a warning.
+func verifyDownloadCanaries(db *databaseReader) error {
+	kind := detectDatabaseKind(db)
+	canaries, enforce := downloadCanaries, true
+	if len(canaries) == 0 {
+		canaries, enforce = defaultCanaries, false
+	}
+
+	checked, changed := checkDownloadCanaries(db, kind, canaries)
+	if checked == 0 {
+		logger.Debug("skipping canary verification", "kind", kind)
+		return nil
+	}
+	for _, change := range changed {
+		logger.Warn("canary changed in new database", "change", change)
+	}
+
+	percent := float64(len(changed)) * 100 / float64(checked)
+	if enforce && percent > canaryMaxChangedPercent {
+		return fmt.Errorf("verification failed: %d of %d canaries changed (%.1f%%, maximum %.1f%%)", len(changed), checked, percent, canaryMaxChangedPercent)
+	}
+	if len(changed) == 0 {
+		logger.Debug("canary verification successful", "canaries", checked)
+	} else if !enforce {
+		logger.Warn("continuing with update, but the changed canaries might indicate an issue", "changed", len(changed), "canaries", checked)
+	}
+	return nil
+}
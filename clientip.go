@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies lists the networks whose forwarding headers are honoured.
+// When empty, forwarding headers are ignored and the peer address is used.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or single IPs.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy network.
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor extracts the for= node identifiers of an RFC 7239
+// Forwarded header, in order. Ports and IPv6 brackets are stripped;
+// obfuscated or "unknown" identifiers are returned as-is and end the walk
+// in clientIP.
+func parseForwardedFor(headers []string) []string {
+	var nodes []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				if strings.HasPrefix(value, "[") {
+					if end := strings.Index(value, "]"); end > 0 {
+						value = value[1:end]
+					}
+				} else if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				nodes = append(nodes, value)
+			}
+		}
+	}
+	return nodes
+}
+
+// splitForwardedList splits comma-separated X-Forwarded-For headers.
+func splitForwardedList(headers []string) []string {
+	var nodes []string
+	for _, header := range headers {
+		for _, node := range strings.Split(header, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	return nodes
+}
+
+// clientIP determines the address of the client that sent r.
+//
+// Forwarding headers are only honoured when the direct peer is a trusted
+// proxy. The Forwarded header takes precedence over X-Forwarded-For, which
+// takes precedence over X-Real-IP. The chain is walked from the nearest hop
+// outwards, skipping trusted proxies, so clients cannot spoof their address
+// by prepending entries. It stops at a node that is not an IP address, e.g.
+// "unknown" or an obfuscated identifier, and returns the nearest trusted
+// hop before it, or the peer address.
+func clientIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return nil, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	if !isTrustedProxy(remote) {
+		return remote, nil
+	}
+
+	chain := parseForwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = splitForwardedList(r.Header.Values("X-Forwarded-For"))
+	}
+	last := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// An "unknown" or obfuscated node hides the hops beyond it
+			logger.Debug("forwarded entry is not an IP address", "entry", chain[i], "client_ip", last.String())
+			return last, nil
+		}
+		if !isTrustedProxy(ip) || i == 0 {
+			return ip, nil
+		}
+		last = ip
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP, nil
+	}
+	return remote, nil
+}
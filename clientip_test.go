@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{"10.0.0.1, fd00::/8", []string{"10.0.0.1/32", "fd00::/8"}, false},
+		{"::1,", []string{"::1/128"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"proxy.local", nil, true},
+	}
+
+	for _, tt := range tests {
+		networks, err := parseTrustedProxies(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, network := range networks {
+			got = append(got, network.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardedFor(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    []string
+	}{
+		{[]string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{[]string{"For=\"[2001:db8:cafe::17]:4711\""}, []string{"2001:db8:cafe::17"}},
+		{[]string{"for=192.0.2.43:8080, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{[]string{"for=192.0.2.43", "for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{[]string{"for=unknown, for=_hidden"}, []string{"unknown", "_hidden"}},
+		{[]string{"proto=https;by=203.0.113.43"}, nil},
+	}
+
+	for _, tt := range tests {
+		if got := parseForwardedFor(tt.headers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseForwardedFor(%q) = %#v, want %#v", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(networks []*net.IPNet) { trustedProxies = networks }(trustedProxies)
+	trustedProxies = proxies
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.9:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.2:1234",
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed entries before the nearest untrusted hop",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.3"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"},
+			want:       "10.0.0.4",
+		},
+		{
+			name:       "forwarded takes precedence",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711", for=10.0.0.3`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:       "forwarded unknown falls back to the peer",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"Forwarded": "for=unknown"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "forwarded obfuscated falls back to the last trusted hop",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"Forwarded": "for=_hidden, for=10.0.0.3"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "x-forwarded-for garbage falls back to the peer",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, garbage"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Real-IP": " 198.51.100.7 "},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "x-forwarded-for takes precedence over x-real-ip",
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.7"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "remote address without port",
+			remoteAddr: "203.0.113.9",
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "invalid remote address",
+			remoteAddr: "pipe",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/me", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			ip, err := clientIP(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && ip.String() != tt.want {
+				t.Errorf("clientIP() = %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// errDatabaseNotModified is returned by downloadGeoLite2DB when upstream has
+// no newer build than the local file, so nothing was downloaded.
+var errDatabaseNotModified = errors.New("database not modified upstream")
+
+// downloadValidators are the cache validators returned with the last
+// downloaded archive, sent back on the next conditional request.
+type downloadValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// archiveDatePattern matches the build date in MaxMind archive names,
+// e.g. GeoLite2-City_20261014.tar.gz.
+var archiveDatePattern = regexp.MustCompile(`_(\d{8})\.tar\.gz$`)
+
+// remoteBuildDate returns the build date announced in a response's
+// Content-Disposition file name, as MaxMind sends it.
+func remoteBuildDate(header http.Header) (time.Time, bool) {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	match := archiveDatePattern.FindStringSubmatch(params["filename"])
+	if match == nil {
+		return time.Time{}, false
+	}
+	date, err := time.Parse("20060102", match[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// localBuildDate returns the UTC build day of the database at dbPath.
+func localBuildDate(dbPath string) (time.Time, bool) {
+	buildEpoch, err := databaseBuildEpoch(dbPath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(buildEpoch), 0).UTC().Truncate(24 * time.Hour), true
+}
+
+// remoteIsNewer checks with a HEAD request whether upstream has a newer build
+// than the local file. It compares the remote build date with the local
+// build epoch, falling back to the ETag and Last-Modified of the last
+// download and then to the local file's modification time. It errs on the
+// side of downloading when it cannot tell.
+func remoteIsNewer(client *http.Client, head *http.Request, dbPath string, validators downloadValidators) bool {
+	localDate, ok := localBuildDate(dbPath)
+	if !ok {
+		return true
+	}
+
+	resp, err := client.Do(head)
+	if err != nil {
+		logger.Debug("HEAD request failed, downloading unconditionally", "path", dbPath, "error", redactURLError(err))
+		return true
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Debug("HEAD request not successful, downloading unconditionally", "path", dbPath, "status", resp.Status)
+		return true
+	}
+
+	if remoteDate, ok := remoteBuildDate(resp.Header); ok {
+		logger.Debug("compared build dates", "path", dbPath, "remote", remoteDate.Format("2006-01-02"), "local", localDate.Format("2006-01-02"))
+		return remoteDate.After(localDate)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && etag == validators.ETag {
+		return false
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+	if lastModified != "" && lastModified == validators.LastModified {
+		return false
+	}
+	// Mirrors without build dates in their file names: compare with the local file
+	if remoteModified, err := http.ParseTime(lastModified); err == nil {
+		if info, err := os.Stat(dbPath); err == nil {
+			return remoteModified.After(info.ModTime())
+		}
+	}
+	return true
+}
+
+// setConditionalHeaders adds If-None-Match and If-Modified-Since to a
+// download request, so servers that support them answer 304 Not Modified.
+func setConditionalHeaders(req *http.Request, dbPath string, validators downloadValidators) {
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	} else if localDate, ok := localBuildDate(dbPath); ok {
+		req.Header.Set("If-Modified-Since", localDate.Add(24*time.Hour-time.Second).Format(http.TimeFormat))
+	}
+}
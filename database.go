@@ -0,0 +1,643 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// databaseKind describes what kind of data a loaded MMDB file provides.
+type databaseKind string
+
+const (
+	kindCountry        databaseKind = "Country"
+	kindCity           databaseKind = "City"
+	kindASN            databaseKind = "ASN"
+	kindAnonymousIP    databaseKind = "Anonymous-IP"
+	kindConnectionType databaseKind = "Connection-Type"
+	kindCustom         databaseKind = "Custom"
+)
+
+// databaseEntry is a single named MMDB file with its own path, edition,
+// update schedule and reload lifecycle.
+type databaseEntry struct {
+	name           string // registry key, e.g. "city", "asn" or a custom name
+	path           string
+	editionID      string // MaxMind edition used for downloads, empty disables downloads
+	updateInterval int    // in hours, 0 disables periodic updates
+
+	mu       sync.RWMutex // protects reader access during reloads
+	reader   atomic.Value // stores *databaseReader
+	networks atomic.Value // stores *maxminddb.Reader on the same file, for prefix lookups
+	kind     atomic.Value // stores databaseKind detected when the file was loaded
+
+	updateMu sync.Mutex // serializes download and reload of this database
+
+	statusMu     sync.Mutex
+	status       updateStatus
+	loadedFile   os.FileInfo   // file the current reader was opened from
+	loadedHandle *databaseFile // open handle on that file, served by /admin/database
+	lastDiff     *databaseDiff // changes made by the latest downloaded build
+	state        updateState   // update bookkeeping persisted next to the file
+}
+
+// updateStatus records the outcome of the latest download and reload attempts.
+type updateStatus struct {
+	LoadedAt            time.Time
+	LastDownloadAt      time.Time
+	LastDownloadError   string
+	DownloadSuccesses   int
+	DownloadFailures    int
+	NotModified         int // update checks that found no newer build
+	ConsecutiveFailures int
+	LastReloadAt        time.Time
+	LastReloadError     string
+	ReloadFailures      int
+	NextUpdateCheck     time.Time // zero when periodic updates are disabled
+}
+
+// databaseRegistry holds all configured databases in configuration order.
+type databaseRegistry struct {
+	mu      sync.RWMutex
+	entries []*databaseEntry
+}
+
+var registry = &databaseRegistry{}
+
+// standardDatabase describes a well-known database that can be configured
+// through GEOIP_<PREFIX>_DB_PATH style environment variables.
+type standardDatabase struct {
+	name      string
+	envPrefix string
+	editionID string
+}
+
+var standardDatabases = []standardDatabase{
+	{name: "country", envPrefix: "COUNTRY", editionID: "GeoLite2-Country"},
+	{name: "city", envPrefix: "CITY", editionID: "GeoLite2-City"},
+	{name: "asn", envPrefix: "ASN", editionID: "GeoLite2-ASN"},
+	{name: "anonymous-ip", envPrefix: "ANONYMOUS_IP", editionID: "GeoIP2-Anonymous-IP"},
+	{name: "connection-type", envPrefix: "CONNECTION_TYPE", editionID: "GeoIP2-Connection-Type"},
+}
+
+// knownEditions maps edition IDs to the name of the database they provide.
+// Besides MaxMind's GeoLite2 and GeoIP2 editions, it covers the
+// GeoIP2-compatible DB-IP databases and IPinfo Lite, which are served through
+// DB_SOURCE_URL. Other IPinfo databases are named after their contents, e.g.
+// country_asn or standard_location.
+var knownEditions = map[string]string{
+	"GeoLite2-Country":       "country",
+	"GeoIP2-Country":         "country",
+	"dbip-country-lite":      "country",
+	"dbip-country":           "country",
+	"GeoLite2-City":          "city",
+	"GeoIP2-City":            "city",
+	"GeoIP2-Enterprise":      "city",
+	"dbip-city-lite":         "city",
+	"dbip-location":          "city",
+	"GeoLite2-ASN":           "asn",
+	"GeoIP2-ISP":             "asn",
+	"dbip-asn-lite":          "asn",
+	"GeoIP2-Anonymous-IP":    "anonymous-ip",
+	"GeoIP2-Connection-Type": "connection-type",
+	"ipinfo_lite":            "country",
+}
+
+// editionDatabaseName returns the name of the database an edition provides,
+// falling back to the edition's name for regional or renamed editions such
+// as GeoIP2-City-Europe.
+func editionDatabaseName(editionID string) (string, bool) {
+	if name, ok := knownEditions[editionID]; ok {
+		return name, true
+	}
+	lower := strings.ToLower(editionID)
+	switch {
+	case strings.Contains(lower, "city"), strings.Contains(lower, "enterprise"), strings.Contains(lower, "location"):
+		return "city", true
+	case strings.Contains(lower, "country"):
+		return "country", true
+	case strings.Contains(lower, "asn"), strings.Contains(lower, "isp"):
+		return "asn", true
+	case strings.Contains(lower, "anonymous"):
+		return "anonymous-ip", true
+	case strings.Contains(lower, "connection"):
+		return "connection-type", true
+	}
+	return "", false
+}
+
+// editionFromFile returns the edition of an existing MMDB file, derived from
+// its database type (e.g. "GeoIP2-City", "DBIP-City-Lite" or
+// "ipinfo country_asn.mmdb").
+func editionFromFile(path string) (string, bool) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer reader.Close()
+
+	if isIPinfoType(reader.Metadata.DatabaseType) {
+		_, product, _ := strings.Cut(reader.Metadata.DatabaseType, " ")
+		editionID := strings.TrimSuffix(product, ".mmdb")
+		_, ok := editionDatabaseName(editionID)
+		return editionID, ok && editionID != ""
+	}
+	dbType, _, _ := strings.Cut(reader.Metadata.DatabaseType, " (compat=")
+	if _, ok := knownEditions[dbType]; ok {
+		return dbType, true
+	}
+	if _, ok := knownEditions[strings.ToLower(dbType)]; ok {
+		return strings.ToLower(dbType), true
+	}
+	if strings.HasPrefix(dbType, "GeoIP2-") || strings.HasPrefix(dbType, "GeoLite2-") {
+		return dbType, true
+	}
+	return "", false
+}
+
+// primaryEdition determines the edition of the primary database: the
+// explicit GEOIP_EDITION_ID, else the type of an existing file, else a guess
+// from the file name.
+func primaryEdition(dbPath string) string {
+	if editionID := os.Getenv("GEOIP_EDITION_ID"); editionID != "" {
+		return editionID
+	}
+	if editionID, ok := editionFromFile(dbPath); ok {
+		logger.Debug("using edition of the existing database", "path", dbPath, "edition", editionID)
+		return editionID
+	}
+	return editionForPath(dbPath)
+}
+
+// Kind returns the kind detected when the database was last loaded.
+func (e *databaseEntry) Kind() databaseKind {
+	if kind, ok := e.kind.Load().(databaseKind); ok {
+		return kind
+	}
+	return ""
+}
+
+// acquire safely retrieves the reader with proper locking.
+// The caller must call the returned unlock function when done.
+func (e *databaseEntry) acquire() (*databaseReader, func(), error) {
+	e.mu.RLock()
+
+	db, ok := e.reader.Load().(*databaseReader)
+	if !ok {
+		e.mu.RUnlock()
+		return nil, nil, fmt.Errorf("database %s not available", e.name)
+	}
+
+	return db, e.mu.RUnlock, nil
+}
+
+// networkReader returns the maxminddb reader on the loaded file, used to
+// find the network an address belongs to. The caller must hold the lock
+// taken by acquire.
+func (e *databaseEntry) networkReader() *maxminddb.Reader {
+	networks, _ := e.networks.Load().(*maxminddb.Reader)
+	return networks
+}
+
+// describe returns the build epoch and MMDB type of the loaded reader, or
+// zero values when nothing is loaded.
+func (e *databaseEntry) describe() (uint, string) {
+	db, unlock, err := e.acquire()
+	if err != nil {
+		return 0, ""
+	}
+	defer unlock()
+	metadata := db.Metadata()
+	return metadata.BuildEpoch, metadata.DatabaseType
+}
+
+// close closes the reader, if any, while holding the write lock.
+func (e *databaseEntry) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if db, ok := e.reader.Load().(*databaseReader); ok {
+		db.Close()
+		logger.Info("database closed", "database", e.name)
+	}
+	if networks, ok := e.networks.Load().(*maxminddb.Reader); ok {
+		networks.Close()
+	}
+
+	e.statusMu.Lock()
+	if e.loadedHandle != nil {
+		e.loadedHandle.retire()
+	}
+	e.statusMu.Unlock()
+}
+
+// LoadedFile returns the file info of the loaded database file, captured
+// when it was opened, or nil when nothing is loaded.
+func (e *databaseEntry) LoadedFile() os.FileInfo {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.loadedFile
+}
+
+// Validators returns the cache validators of the last downloaded archive.
+func (e *databaseEntry) Validators() downloadValidators {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.state.Validators
+}
+
+func (e *databaseEntry) setValidators(validators downloadValidators) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	e.state.Validators = validators
+}
+
+// LastDiff returns the diff report of the latest downloaded build, or nil.
+func (e *databaseEntry) LastDiff() *databaseDiff {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.lastDiff
+}
+
+// recordDiff stores and logs the diff report of a downloaded build.
+func (e *databaseEntry) recordDiff(diff *databaseDiff) {
+	if diff == nil {
+		return
+	}
+	diff.Database = e.name
+	e.statusMu.Lock()
+	e.lastDiff = diff
+	e.statusMu.Unlock()
+	logDatabaseDiff(diff)
+}
+
+// Status returns a copy of the entry's update status.
+func (e *databaseEntry) Status() updateStatus {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.status
+}
+
+// recordDownload records the outcome of a download attempt and persists the
+// update state.
+func (e *databaseEntry) recordDownload(err error) {
+	buildEpoch, epochErr := databaseBuildEpoch(e.path)
+
+	e.statusMu.Lock()
+	now := time.Now()
+	e.status.LastDownloadAt = now
+	e.state.LastAttempt = now
+	switch {
+	case errors.Is(err, errDatabaseNotModified):
+		e.status.LastDownloadError = ""
+		e.status.NotModified++
+		e.status.ConsecutiveFailures = 0
+		e.state.LastCheck = now
+	case err != nil:
+		e.status.LastDownloadError = err.Error()
+		e.status.DownloadFailures++
+		e.status.ConsecutiveFailures++
+		e.state.NextRetry = time.Time{}
+		if delay := retryDelay(err, e.status.ConsecutiveFailures); delay > 0 {
+			e.state.NextRetry = now.Add(delay)
+		}
+	default:
+		e.status.LastDownloadError = ""
+		e.status.DownloadSuccesses++
+		e.status.ConsecutiveFailures = 0
+		e.state.LastCheck = now
+		e.state.LastDownload = now
+		e.state.RolledBackBuildEpoch = 0
+	}
+	if err == nil || errors.Is(err, errDatabaseNotModified) {
+		e.state.NextRetry = time.Time{}
+	}
+	e.state.LastError = e.status.LastDownloadError
+	e.state.ConsecutiveFailures = e.status.ConsecutiveFailures
+	if epochErr == nil {
+		e.state.BuildEpoch = buildEpoch
+	}
+	e.statusMu.Unlock()
+
+	e.persistState()
+}
+
+// recordReload records the outcome of a reload attempt.
+func (e *databaseEntry) recordReload(err error) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+
+	now := time.Now()
+	e.status.LastReloadAt = now
+	if err != nil {
+		e.status.LastReloadError = err.Error()
+		e.status.ReloadFailures++
+		return
+	}
+	e.status.LastReloadError = ""
+	e.status.LoadedAt = now
+}
+
+// recordNextCheck records when the periodic updater will next check the database.
+func (e *databaseEntry) recordNextCheck(at time.Time) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	e.status.NextUpdateCheck = at
+}
+
+// add registers a database entry. Entries are searched in registration order.
+func (r *databaseRegistry) add(entry *databaseEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// get returns the entry with the given name, or nil.
+func (r *databaseRegistry) get(name string) *databaseEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, entry := range r.entries {
+		if entry.name == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// all returns a snapshot of the registered entries.
+func (r *databaseRegistry) all() []*databaseEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*databaseEntry(nil), r.entries...)
+}
+
+// find returns the first loaded entry matching the given kinds, in order of
+// preference. For example find(kindCity, kindCountry) prefers a City database.
+func (r *databaseRegistry) find(kinds ...databaseKind) *databaseEntry {
+	entries := r.all()
+	for _, kind := range kinds {
+		for _, entry := range entries {
+			if entry.Kind() == kind {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// getDatabase safely retrieves the best loaded reader for the given kinds.
+// Returns the reader, its kind, and any error.
+// The caller must call the returned unlock function when done.
+func getDatabase(kinds ...databaseKind) (*databaseReader, databaseKind, func(), error) {
+	entry := registry.find(kinds...)
+	if entry == nil {
+		return nil, "", nil, fmt.Errorf("database not available")
+	}
+
+	db, unlock, err := entry.acquire()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return db, entry.Kind(), unlock, nil
+}
+
+// detectDatabaseKind classifies a database by its metadata type string,
+// e.g. "GeoLite2-City", "GeoIP2-Enterprise" or "GeoLite2-ASN".
+func detectDatabaseKind(db *databaseReader) databaseKind {
+	dbType := db.Metadata().DatabaseType
+	switch {
+	case isIPinfoType(dbType):
+		return ipinfoKind(dbType)
+	case strings.Contains(dbType, "City"), strings.Contains(dbType, "Enterprise"):
+		return kindCity
+	case strings.Contains(dbType, "Country"):
+		return kindCountry
+	case strings.Contains(dbType, "ASN"), strings.Contains(dbType, "ISP"):
+		return kindASN
+	case strings.Contains(dbType, "Anonymous-IP"):
+		return kindAnonymousIP
+	case strings.Contains(dbType, "Connection-Type"):
+		return kindConnectionType
+	default:
+		return kindCustom
+	}
+}
+
+// reloadDatabase opens the entry's file and atomically swaps it in,
+// closing the previous reader.
+func reloadDatabase(entry *databaseEntry) error {
+	newDB, newNetworks, file, err := openDatabase(entry.path)
+	if err != nil {
+		err = fmt.Errorf("failed to open new database: %w", err)
+		entry.recordReload(err)
+		return err
+	}
+
+	// Detect database type for the new database (without storing yet)
+	newKind := detectDatabaseKind(newDB)
+
+	// Acquire write lock to swap databases atomically
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	// Atomically swap both the database and its kind together
+	oldDB := entry.reader.Swap(newDB)
+	oldNetworks := entry.networks.Swap(newNetworks)
+	entry.kind.Store(newKind)
+
+	entry.recordReload(nil)
+	metadata := newDB.Metadata()
+	file.buildEpoch, file.databaseType = metadata.BuildEpoch, metadata.DatabaseType
+	entry.statusMu.Lock()
+	oldFile := entry.loadedHandle
+	entry.loadedFile, entry.loadedHandle = file.info, file
+	// Files replaced by rollbacks or external updaters change the build in the state
+	stateChanged := entry.editionID != "" && entry.state.BuildEpoch != metadata.BuildEpoch
+	entry.state.BuildEpoch = metadata.BuildEpoch
+	entry.statusMu.Unlock()
+	if stateChanged {
+		entry.persistState()
+	}
+	logger.Info("database loaded", "database", entry.name, "path", entry.path, "kind", newKind, "type", metadata.DatabaseType, "build_epoch", metadata.BuildEpoch)
+
+	// Close old database if it exists
+	if oldFile != nil {
+		oldFile.retire()
+	}
+	if oldDB != nil {
+		if oldReader, ok := oldDB.(*databaseReader); ok {
+			logger.Info("closing old database", "database", entry.name)
+			oldReader.Close()
+		}
+	}
+	if oldNetworks != nil {
+		oldNetworks.(*maxminddb.Reader).Close()
+	}
+
+	return nil
+}
+
+// loadDatabaseConfig builds the database entries from the environment.
+//
+// The primary database (GEOIP_DB_PATH, or GEOIP_DB_DIR + GEOIP_DB_FILENAME)
+// keeps its historical behaviour. Additional databases are configured with
+// GEOIP_<PREFIX>_DB_PATH or GEOIP_<PREFIX>_DB_FILENAME, where PREFIX is one of
+// COUNTRY, CITY, ASN, ANONYMOUS_IP or CONNECTION_TYPE, and custom databases
+// with GEOIP_CUSTOM_DATABASES=name=path[@edition],...
+func loadDatabaseConfig(defaultIntervalHours int) ([]*databaseEntry, error) {
+	dbDir := os.Getenv("GEOIP_DB_DIR")
+	primaryPath := os.Getenv("GEOIP_DB_PATH") // Highest precedence
+	editionIDs := os.Getenv("GEOIP_EDITION_IDS")
+	// With a list of editions, GEOIP_DB_DIR alone only says where they are
+	// stored; the image sets GEOIP_DB_DIR rather than GEOIP_DB_PATH for this reason
+	primaryExplicit := primaryPath != "" || os.Getenv("GEOIP_DB_FILENAME") != "" || os.Getenv("GEOIP_EDITION_ID") != "" ||
+		(dbDir != "" && editionIDs == "")
+	if primaryPath == "" {
+		if dbDir != "" {
+			dbFileName := os.Getenv("GEOIP_DB_FILENAME")
+			if dbFileName == "" {
+				dbFileName = "GeoLite2-Country.mmdb" // Default filename if only directory is specified
+			}
+			primaryPath = filepath.Join(dbDir, dbFileName)
+		} else {
+			primaryPath = "/data/GeoLite2-Country.mmdb" // Global default if neither path nor dir is specified
+		}
+	}
+	if dbDir == "" {
+		dbDir = filepath.Dir(primaryPath)
+	}
+
+	var entries []*databaseEntry
+	seen := make(map[string]bool)
+	addEntry := func(entry *databaseEntry) error {
+		if seen[entry.name] {
+			return fmt.Errorf("database %q configured more than once", entry.name)
+		}
+		seen[entry.name] = true
+		entries = append(entries, entry)
+		return nil
+	}
+
+	for _, std := range standardDatabases {
+		path := os.Getenv("GEOIP_" + std.envPrefix + "_DB_PATH")
+		if path == "" {
+			if fileName := os.Getenv("GEOIP_" + std.envPrefix + "_DB_FILENAME"); fileName != "" {
+				path = filepath.Join(dbDir, fileName)
+			}
+		}
+		if path == "" {
+			continue
+		}
+
+		editionID := os.Getenv("GEOIP_" + std.envPrefix + "_EDITION_ID")
+		if editionID == "" {
+			editionID = std.editionID
+		}
+		if err := addEntry(&databaseEntry{
+			name:           std.name,
+			path:           path,
+			editionID:      editionID,
+			updateInterval: nonNegativeIntFromEnv("GEOIP_"+std.envPrefix+"_UPDATE_INTERVAL_HOURS", defaultIntervalHours),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Editions listed in GEOIP_EDITION_IDS are stored as <edition>.mmdb
+	listedEditions := false
+	for _, editionID := range strings.Split(editionIDs, ",") {
+		editionID = strings.TrimSpace(editionID)
+		if editionID == "" {
+			continue
+		}
+		name, ok := editionDatabaseName(editionID)
+		if !ok {
+			return nil, fmt.Errorf("unknown edition %q in GEOIP_EDITION_IDS, configure it with GEOIP_CUSTOM_DATABASES instead", editionID)
+		}
+		listedEditions = true
+		if err := addEntry(&databaseEntry{
+			name:           name,
+			path:           filepath.Join(dbDir, editionID+".mmdb"),
+			editionID:      editionID,
+			updateInterval: defaultIntervalHours,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// An explicitly configured primary database is always loaded. The default
+	// one is only loaded when no editions were listed and no per-kind
+	// Country/City database was configured in its place.
+	primaryEditionID := primaryEdition(primaryPath)
+	primaryName, ok := editionDatabaseName(primaryEditionID)
+	if !ok {
+		return nil, fmt.Errorf("unknown edition %q in GEOIP_EDITION_ID, configure it with GEOIP_CUSTOM_DATABASES instead", primaryEditionID)
+	}
+	if !seen[primaryName] && (primaryExplicit || (!listedEditions && !seen["country"] && !seen["city"])) {
+		entries = append([]*databaseEntry{{
+			name:           primaryName,
+			path:           primaryPath,
+			editionID:      primaryEditionID,
+			updateInterval: defaultIntervalHours,
+		}}, entries...)
+		seen[primaryName] = true
+	}
+
+	if custom := os.Getenv("GEOIP_CUSTOM_DATABASES"); custom != "" {
+		for _, spec := range strings.Split(custom, ",") {
+			spec = strings.TrimSpace(spec)
+			if spec == "" {
+				continue
+			}
+			name, path, ok := strings.Cut(spec, "=")
+			if !ok || name == "" || path == "" {
+				return nil, fmt.Errorf("invalid GEOIP_CUSTOM_DATABASES entry %q, expected name=path[@edition]", spec)
+			}
+			path, editionID, _ := strings.Cut(path, "@")
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dbDir, path)
+			}
+			interval := 0
+			if editionID != "" {
+				interval = defaultIntervalHours
+			}
+			if err := addEntry(&databaseEntry{
+				name:           name,
+				path:           path,
+				editionID:      editionID,
+				updateInterval: interval,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// nonNegativeIntFromEnv parses a non-negative integer setting, such as an
+// interval, a count or a size, falling back to def.
+func nonNegativeIntFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Warn("invalid setting, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	if i < 0 {
+		logger.Warn("setting must be non-negative, using default", "name", name, "value", value, "default", def)
+		return def
+	}
+	return i
+}
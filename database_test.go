@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLoadDatabaseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string // name=path@edition
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: []string{"country=/data/GeoLite2-Country.mmdb@GeoLite2-Country"},
+		},
+		{
+			name: "image default directory",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data"},
+			want: []string{"country=/data/GeoLite2-Country.mmdb@GeoLite2-Country"},
+		},
+		{
+			name: "explicit path",
+			env:  map[string]string{"GEOIP_DB_PATH": "/db/GeoLite2-City.mmdb"},
+			want: []string{"city=/db/GeoLite2-City.mmdb@GeoLite2-City"},
+		},
+		{
+			name: "edition list replaces the default database",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data", "GEOIP_EDITION_IDS": "GeoIP2-City, GeoIP2-ISP"},
+			want: []string{"city=/data/GeoIP2-City.mmdb@GeoIP2-City", "asn=/data/GeoIP2-ISP.mmdb@GeoIP2-ISP"},
+		},
+		{
+			name: "edition list without a country database",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data", "GEOIP_EDITION_IDS": "GeoIP2-ISP"},
+			want: []string{"asn=/data/GeoIP2-ISP.mmdb@GeoIP2-ISP"},
+		},
+		{
+			name: "edition list with an explicit path",
+			env:  map[string]string{"GEOIP_DB_PATH": "/db/GeoLite2-Country.mmdb", "GEOIP_EDITION_IDS": "GeoIP2-ISP"},
+			want: []string{"country=/db/GeoLite2-Country.mmdb@GeoLite2-Country", "asn=/db/GeoIP2-ISP.mmdb@GeoIP2-ISP"},
+		},
+		{
+			name: "edition list with an explicit edition",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data", "GEOIP_EDITION_ID": "GeoLite2-Country", "GEOIP_EDITION_IDS": "GeoIP2-ISP"},
+			want: []string{"country=/data/GeoLite2-Country.mmdb@GeoLite2-Country", "asn=/data/GeoIP2-ISP.mmdb@GeoIP2-ISP"},
+		},
+		{
+			name: "edition list with an explicit file name",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data", "GEOIP_DB_FILENAME": "GeoLite2-City.mmdb", "GEOIP_EDITION_IDS": "GeoIP2-ISP"},
+			want: []string{"city=/data/GeoLite2-City.mmdb@GeoLite2-City", "asn=/data/GeoIP2-ISP.mmdb@GeoIP2-ISP"},
+		},
+		{
+			name: "edition list covering the primary database",
+			env:  map[string]string{"GEOIP_DB_PATH": "/data/GeoLite2-City.mmdb", "GEOIP_EDITION_IDS": "GeoLite2-City"},
+			want: []string{"city=/data/GeoLite2-City.mmdb@GeoLite2-City"},
+		},
+		{
+			name: "per-kind database next to the primary database",
+			env:  map[string]string{"GEOIP_DB_PATH": "/db/GeoLite2-City.mmdb", "GEOIP_ASN_DB_FILENAME": "GeoLite2-ASN.mmdb"},
+			want: []string{"city=/db/GeoLite2-City.mmdb@GeoLite2-City", "asn=/db/GeoLite2-ASN.mmdb@GeoLite2-ASN"},
+		},
+		{
+			name: "per-kind city database replaces the default database",
+			env:  map[string]string{"GEOIP_CITY_DB_PATH": "/db/City.mmdb"},
+			want: []string{"city=/db/City.mmdb@GeoLite2-City"},
+		},
+		{
+			name: "per-kind ASN database keeps the default database",
+			env:  map[string]string{"GEOIP_ASN_DB_PATH": "/db/ASN.mmdb"},
+			want: []string{"country=/data/GeoLite2-Country.mmdb@GeoLite2-Country", "asn=/db/ASN.mmdb@GeoLite2-ASN"},
+		},
+		{
+			name: "custom databases",
+			env:  map[string]string{"GEOIP_DB_DIR": "/data", "GEOIP_CUSTOM_DATABASES": "blocks=blocks.mmdb, proxies=/db/proxies.mmdb@GeoIP2-Anonymous-IP"},
+			want: []string{"country=/data/GeoLite2-Country.mmdb@GeoLite2-Country", "blocks=/data/blocks.mmdb@", "proxies=/db/proxies.mmdb@GeoIP2-Anonymous-IP"},
+		},
+		{
+			name:    "edition listed twice",
+			env:     map[string]string{"GEOIP_EDITION_IDS": "GeoIP2-ISP,GeoLite2-ASN"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown edition",
+			env:     map[string]string{"GEOIP_EDITION_IDS": "GeoIP2-Unknown"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid custom database",
+			env:     map[string]string{"GEOIP_CUSTOM_DATABASES": "blocks"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"GEOIP_DB_PATH", "GEOIP_DB_DIR", "GEOIP_DB_FILENAME", "GEOIP_EDITION_ID", "GEOIP_EDITION_IDS", "GEOIP_CUSTOM_DATABASES"} {
+				t.Setenv(name, "")
+			}
+			for _, std := range standardDatabases {
+				for _, suffix := range []string{"_DB_PATH", "_DB_FILENAME", "_EDITION_ID", "_UPDATE_INTERVAL_HOURS"} {
+					t.Setenv("GEOIP_"+std.envPrefix+suffix, "")
+				}
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			entries, err := loadDatabaseConfig(24)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadDatabaseConfig() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDatabaseConfig() error = %v", err)
+			}
+			got := make([]string, len(entries))
+			for i, entry := range entries {
+				got[i] = fmt.Sprintf("%s=%s@%s", entry.name, entry.path, entry.editionID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadDatabaseConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	diffTopTransitions = 20   // country transitions listed in a diff report
+	diffTopNetworks    = 20   // largest changed networks listed in a diff report
+	diffMaxWatched     = 1000 // watched changes kept in a diff report
+)
+
+var (
+	// diffReportsEnabled controls whether downloads are diffed against the
+	// database they replace.
+	diffReportsEnabled = true
+
+	// diffWatchValues are countries (or "AS<number>") whose every change is
+	// recorded in the diff report and logged as a warning.
+	diffWatchValues = map[string]bool{}
+)
+
+// databaseDiff summarizes how a new build of a database differs from the one
+// it replaced. Values are country codes, or "AS<number>" for ASN databases.
+type databaseDiff struct {
+	Database      string    `json:"database"`
+	OldBuildEpoch uint      `json:"old_build_epoch"`
+	NewBuildEpoch uint      `json:"new_build_epoch"`
+	ComputedAt    time.Time `json:"computed_at"`
+	DurationMs    float64   `json:"duration_ms"`
+
+	OldNetworks     int `json:"old_networks"`
+	NewNetworks     int `json:"new_networks"`
+	ChangedNetworks int `json:"changed_networks"`
+	AddedNetworks   int `json:"added_networks"`
+	RemovedNetworks int `json:"removed_networks"`
+
+	Transitions     []diffTransition `json:"transitions"`
+	TopChanged      []networkChange  `json:"top_changed"`
+	Watched         []networkChange  `json:"watched,omitempty"`
+	WatchedComplete bool             `json:"watched_complete"`
+}
+
+// diffTransition counts the networks that moved from one value to another.
+type diffTransition struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Networks int    `json:"networks"`
+}
+
+// networkChange is a single changed, added or removed network.
+type networkChange struct {
+	Network string `json:"network"`
+	Change  string `json:"change"` // "changed", "added" or "removed"
+	Old     string `json:"old,omitempty"`
+	New     string `json:"new,omitempty"`
+	bits    int    // normalized prefix length, smaller means larger network
+}
+
+// networkValue is the part of a record compared between builds.
+type networkValue struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// ipinfoNetworkValue extracts the compared part of an IPinfo record.
+func ipinfoNetworkValue(record *ipinfoRecord) networkValue {
+	var v networkValue
+	v.Country.IsoCode = record.countryCode()
+	v.ASN = record.asNumber()
+	return v
+}
+
+func (v networkValue) key() string {
+	if v.Country.IsoCode != "" {
+		return v.Country.IsoCode
+	}
+	if v.ASN != 0 {
+		return fmt.Sprintf("AS%d", v.ASN)
+	}
+	return ""
+}
+
+// networkCursor walks the networks of a database in address order. IPv4
+// networks are normalized into the ::/96 range so IPv4 and IPv6 databases
+// compare consistently.
+type networkCursor struct {
+	networks *maxminddb.Networks
+	ipinfo   bool // records use the IPinfo layout
+	ok       bool
+
+	network    string
+	bits       int
+	start, end [16]byte
+	value      string
+
+	overlapped  bool   // an overlapping network exists in the other database
+	changedFrom string // first differing old value, for new networks
+	changed     bool
+}
+
+func newNetworkCursor(reader *maxminddb.Reader) (*networkCursor, error) {
+	cursor := &networkCursor{
+		networks: reader.Networks(maxminddb.SkipAliasedNetworks),
+		ipinfo:   isIPinfoType(reader.Metadata.DatabaseType),
+	}
+	return cursor, cursor.next()
+}
+
+func (c *networkCursor) next() error {
+	c.overlapped, c.changed, c.changedFrom = false, false, ""
+	c.ok = c.networks.Next()
+	if !c.ok {
+		return c.networks.Err()
+	}
+
+	var value networkValue
+	var network *net.IPNet
+	var err error
+	if c.ipinfo {
+		var record ipinfoRecord
+		network, err = c.networks.Network(&record)
+		value = ipinfoNetworkValue(&record)
+	} else {
+		network, err = c.networks.Network(&value)
+	}
+	if err != nil {
+		return err
+	}
+	ones, _ := network.Mask.Size()
+	ip := network.IP
+	if ip4 := ip.To4(); len(ip) == net.IPv4len && ip4 != nil {
+		ip = append(make(net.IP, 12), ip4...)
+		ones += 96
+	}
+
+	c.network = network.String()
+	c.bits = ones
+	copy(c.start[:], ip.To16())
+	c.end = c.start
+	for i := ones; i < 128; i++ {
+		c.end[i/8] |= 1 << (7 - i%8)
+	}
+	c.value = value.key()
+	return nil
+}
+
+// diffBuilder accumulates a diff report while the cursors advance.
+type diffBuilder struct {
+	diff        *databaseDiff
+	transitions map[[2]string]int
+}
+
+func (b *diffBuilder) record(change networkChange) {
+	switch change.Change {
+	case "changed":
+		b.diff.ChangedNetworks++
+		b.transitions[[2]string{change.Old, change.New}]++
+		b.diff.TopChanged = append(b.diff.TopChanged, change)
+		if len(b.diff.TopChanged) > 4*diffTopNetworks {
+			b.trimTopChanged()
+		}
+	case "added":
+		b.diff.AddedNetworks++
+	case "removed":
+		b.diff.RemovedNetworks++
+	}
+
+	if diffWatchValues[change.Old] || diffWatchValues[change.New] {
+		if len(b.diff.Watched) < diffMaxWatched {
+			b.diff.Watched = append(b.diff.Watched, change)
+		} else {
+			b.diff.WatchedComplete = false
+		}
+	}
+}
+
+// trimTopChanged keeps only the largest changed networks.
+func (b *diffBuilder) trimTopChanged() {
+	sort.SliceStable(b.diff.TopChanged, func(i, j int) bool {
+		return b.diff.TopChanged[i].bits < b.diff.TopChanged[j].bits
+	})
+	if len(b.diff.TopChanged) > diffTopNetworks {
+		b.diff.TopChanged = b.diff.TopChanged[:diffTopNetworks]
+	}
+}
+
+func (b *diffBuilder) finishOld(c *networkCursor) {
+	b.diff.OldNetworks++
+	if !c.overlapped {
+		b.record(networkChange{Network: c.network, Change: "removed", Old: c.value, bits: c.bits})
+	}
+}
+
+func (b *diffBuilder) finishNew(c *networkCursor) {
+	b.diff.NewNetworks++
+	if !c.overlapped {
+		b.record(networkChange{Network: c.network, Change: "added", New: c.value, bits: c.bits})
+	} else if c.changed {
+		b.record(networkChange{Network: c.network, Change: "changed", Old: c.changedFrom, New: c.value, bits: c.bits})
+	}
+}
+
+// diffDatabaseFiles compares the networks of two MMDB files. Both are walked
+// in address order at the same time, so memory use does not depend on the
+// database size. A new network counts as changed when any overlapping old
+// network had a different value.
+func diffDatabaseFiles(oldPath, newPath string) (*databaseDiff, error) {
+	start := time.Now()
+
+	oldReader, err := maxminddb.Open(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open old database: %w", err)
+	}
+	defer oldReader.Close()
+	newReader, err := maxminddb.Open(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open new database: %w", err)
+	}
+	defer newReader.Close()
+
+	b := &diffBuilder{
+		diff: &databaseDiff{
+			OldBuildEpoch:   oldReader.Metadata.BuildEpoch,
+			NewBuildEpoch:   newReader.Metadata.BuildEpoch,
+			Transitions:     []diffTransition{},
+			TopChanged:      []networkChange{},
+			WatchedComplete: true,
+		},
+		transitions: make(map[[2]string]int),
+	}
+
+	oldNets, err := newNetworkCursor(oldReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read old database: %w", err)
+	}
+	newNets, err := newNetworkCursor(newReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read new database: %w", err)
+	}
+
+	for oldNets.ok || newNets.ok {
+		var advanceOld, advanceNew bool
+		switch {
+		case !newNets.ok || (oldNets.ok && bytes.Compare(oldNets.end[:], newNets.start[:]) < 0):
+			advanceOld = true
+		case !oldNets.ok || bytes.Compare(newNets.end[:], oldNets.start[:]) < 0:
+			advanceNew = true
+		default:
+			oldNets.overlapped, newNets.overlapped = true, true
+			if oldNets.value != newNets.value && !newNets.changed {
+				newNets.changed, newNets.changedFrom = true, oldNets.value
+			}
+			cmp := bytes.Compare(oldNets.end[:], newNets.end[:])
+			advanceOld, advanceNew = cmp <= 0, cmp >= 0
+		}
+
+		if advanceOld {
+			b.finishOld(oldNets)
+			if err := oldNets.next(); err != nil {
+				return nil, fmt.Errorf("failed to read old database: %w", err)
+			}
+		}
+		if advanceNew {
+			b.finishNew(newNets)
+			if err := newNets.next(); err != nil {
+				return nil, fmt.Errorf("failed to read new database: %w", err)
+			}
+		}
+	}
+
+	b.trimTopChanged()
+	for transition, count := range b.transitions {
+		b.diff.Transitions = append(b.diff.Transitions, diffTransition{From: transition[0], To: transition[1], Networks: count})
+	}
+	sort.Slice(b.diff.Transitions, func(i, j int) bool {
+		a, c := b.diff.Transitions[i], b.diff.Transitions[j]
+		if a.Networks != c.Networks {
+			return a.Networks > c.Networks
+		}
+		return a.From+a.To < c.From+c.To
+	})
+	if len(b.diff.Transitions) > diffTopTransitions {
+		b.diff.Transitions = b.diff.Transitions[:diffTopTransitions]
+	}
+
+	b.diff.ComputedAt = time.Now()
+	b.diff.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return b.diff, nil
+}
+
+// parseDiffWatchValues parses a comma-separated list of country codes or ASNs.
+func parseDiffWatchValues(value string) map[string]bool {
+	values := map[string]bool{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+			values[v] = true
+		}
+	}
+	return values
+}
+
+// logDatabaseDiff writes a diff summary, and every watched change, to the log.
+func logDatabaseDiff(diff *databaseDiff) {
+	transitions := make([]string, len(diff.Transitions))
+	for i, t := range diff.Transitions {
+		transitions[i] = fmt.Sprintf("%s->%s:%d", t.From, t.To, t.Networks)
+	}
+	logger.Info("database diff", "database", diff.Database,
+		"old_build_epoch", diff.OldBuildEpoch, "new_build_epoch", diff.NewBuildEpoch,
+		"changed", diff.ChangedNetworks, "added", diff.AddedNetworks, "removed", diff.RemovedNetworks,
+		"transitions", strings.Join(transitions, ","), "duration_ms", diff.DurationMs)
+
+	for _, change := range diff.Watched {
+		logger.Warn("watched network changed", "database", diff.Database, "network", change.Network,
+			"change", change.Change, "old", change.Old, "new", change.New, "new_build_epoch", diff.NewBuildEpoch)
+	}
+	if !diff.WatchedComplete {
+		logger.Warn("watched network changes truncated", "database", diff.Database, "limit", diffMaxWatched)
+	}
+}
+
+// diffHandler returns the latest diff report of every database (or the one
+// selected with ?database=) as JSON.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("database")
+	diffs := []*databaseDiff{}
+	for _, entry := range registry.all() {
+		if name != "" && entry.name != name {
+			continue
+		}
+		if diff := entry.LastDiff(); diff != nil {
+			diffs = append(diffs, diff)
+		}
+	}
+	if name != "" && registry.get(name) == nil {
+		http.Error(w, fmt.Sprintf("unknown database %q", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffs)
+}
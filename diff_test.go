@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The fixtures hold the same networks, except that Country-new.mmdb moves
+// 5.9.0.0/16 from DE to FR and adds 77.0.0.0/8 (FR).
+const (
+	diffOldFixture = "testdata/Country-old.mmdb"
+	diffNewFixture = "testdata/Country-new.mmdb"
+)
+
+func TestDiffDatabaseFiles(t *testing.T) {
+	tests := []struct {
+		name            string
+		oldPath         string
+		newPath         string
+		watch           string
+		wantCounts      [5]int // old, new, changed, added, removed
+		wantTransitions []diffTransition
+		wantTopChanged  []string
+		wantWatched     []networkChange
+	}{
+		{
+			name:            "unchanged",
+			oldPath:         diffOldFixture,
+			newPath:         diffOldFixture,
+			wantCounts:      [5]int{5, 5, 0, 0, 0},
+			wantTransitions: []diffTransition{},
+			wantTopChanged:  []string{},
+		},
+		{
+			name:            "changed and added",
+			oldPath:         diffOldFixture,
+			newPath:         diffNewFixture,
+			wantCounts:      [5]int{5, 6, 1, 1, 0},
+			wantTransitions: []diffTransition{{From: "DE", To: "FR", Networks: 1}},
+			wantTopChanged:  []string{"5.9.0.0/16"},
+		},
+		{
+			name:            "changed and removed",
+			oldPath:         diffNewFixture,
+			newPath:         diffOldFixture,
+			wantCounts:      [5]int{6, 5, 1, 0, 1},
+			wantTransitions: []diffTransition{{From: "FR", To: "DE", Networks: 1}},
+			wantTopChanged:  []string{"5.9.0.0/16"},
+		},
+		{
+			name:            "watched values",
+			oldPath:         diffOldFixture,
+			newPath:         diffNewFixture,
+			watch:           "fr",
+			wantCounts:      [5]int{5, 6, 1, 1, 0},
+			wantTransitions: []diffTransition{{From: "DE", To: "FR", Networks: 1}},
+			wantTopChanged:  []string{"5.9.0.0/16"},
+			wantWatched: []networkChange{
+				{Network: "5.9.0.0/16", Change: "changed", Old: "DE", New: "FR"},
+				{Network: "77.0.0.0/8", Change: "added", New: "FR"},
+			},
+		},
+	}
+
+	defer func(values map[string]bool) { diffWatchValues = values }(diffWatchValues)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffWatchValues = parseDiffWatchValues(tt.watch)
+
+			diff, err := diffDatabaseFiles(tt.oldPath, tt.newPath)
+			if err != nil {
+				t.Fatalf("diffDatabaseFiles() error = %v", err)
+			}
+
+			counts := [5]int{diff.OldNetworks, diff.NewNetworks, diff.ChangedNetworks, diff.AddedNetworks, diff.RemovedNetworks}
+			if counts != tt.wantCounts {
+				t.Errorf("counts (old, new, changed, added, removed) = %v, want %v", counts, tt.wantCounts)
+			}
+			if !reflect.DeepEqual(diff.Transitions, tt.wantTransitions) {
+				t.Errorf("transitions = %+v, want %+v", diff.Transitions, tt.wantTransitions)
+			}
+			topChanged := []string{}
+			for _, change := range diff.TopChanged {
+				topChanged = append(topChanged, change.Network)
+			}
+			if !reflect.DeepEqual(topChanged, tt.wantTopChanged) {
+				t.Errorf("top changed = %v, want %v", topChanged, tt.wantTopChanged)
+			}
+			var watched []networkChange
+			for _, change := range diff.Watched {
+				change.bits = 0
+				watched = append(watched, change)
+			}
+			if !reflect.DeepEqual(watched, tt.wantWatched) {
+				t.Errorf("watched = %+v, want %+v", watched, tt.wantWatched)
+			}
+			if !diff.WatchedComplete {
+				t.Error("watched changes reported as incomplete")
+			}
+		})
+	}
+}
+
+func TestDiffDatabaseFilesMissing(t *testing.T) {
+	if _, err := diffDatabaseFiles("testdata/missing.mmdb", diffNewFixture); err == nil {
+		t.Error("diffDatabaseFiles() with a missing old database succeeded")
+	}
+	if _, err := diffDatabaseFiles(diffOldFixture, "testdata/missing.mmdb"); err == nil {
+		t.Error("diffDatabaseFiles() with a missing new database succeeded")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// databaseFile is an open handle on a loaded database file. Database files
+// are replaced by rename, so the handle keeps reading the loaded bytes even
+// after the path points to a newer file. It is closed once its reader was
+// replaced and no download of it is in progress.
+type databaseFile struct {
+	file         *os.File
+	info         os.FileInfo
+	size         int64
+	buildEpoch   uint
+	databaseType string
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+
+	hashOnce sync.Once
+	sum      string
+	hashErr  error
+}
+
+// openDatabase opens the database file at path with both readers and a
+// handle on the same file. If the file is replaced while opening, it is
+// opened again.
+func openDatabase(path string) (*databaseReader, *maxminddb.Reader, *databaseFile, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		db, err := openReader(path)
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		networks, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			f.Close()
+			return nil, nil, nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(info, current) {
+			return db, networks, &databaseFile{file: f, info: info, size: info.Size()}, nil
+		}
+		networks.Close()
+		db.Close()
+		f.Close()
+	}
+	return nil, nil, nil, fmt.Errorf("file %s kept changing while it was opened", path)
+}
+
+// acquire reserves the handle for reading. It fails once the handle was retired.
+func (f *databaseFile) acquire() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.retired {
+		return false
+	}
+	f.refs++
+	return true
+}
+
+// release ends a read started with acquire.
+func (f *databaseFile) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.retired && f.refs == 0 {
+		f.file.Close()
+	}
+}
+
+// retire closes the handle as soon as no read is in progress.
+func (f *databaseFile) retire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.retired {
+		return
+	}
+	f.retired = true
+	if f.refs == 0 {
+		f.file.Close()
+	}
+}
+
+// checksum returns the SHA256 hex digest of the file, computed on first use.
+func (f *databaseFile) checksum() (string, error) {
+	f.hashOnce.Do(func() {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+			f.hashErr = err
+			return
+		}
+		f.sum = hex.EncodeToString(hash.Sum(nil))
+	})
+	return f.sum, f.hashErr
+}
+
+// acquireFile returns the handle of the loaded database file, reserved for
+// reading, or nil when nothing is loaded. The caller must release it.
+func (e *databaseEntry) acquireFile() *databaseFile {
+	e.statusMu.Lock()
+	file := e.loadedHandle
+	e.statusMu.Unlock()
+	if file == nil || !file.acquire() {
+		return nil
+	}
+	return file
+}
+
+// adminDatabaseHandler streams the exact MMDB file currently loaded for the
+// database named with ?database= (optional when only one is configured), so
+// batch jobs can work offline on the same build the API serves. The ETag is
+// the file's SHA256 digest and Last-Modified its build time, so Range
+// requests and conditional GETs work as usual.
+func adminDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	var entry *databaseEntry
+	if name := r.URL.Query().Get("database"); name != "" {
+		if entry = registry.get(name); entry == nil {
+			http.Error(w, fmt.Sprintf("unknown database %q", name), http.StatusNotFound)
+			return
+		}
+	} else if entries := registry.all(); len(entries) == 1 {
+		entry = entries[0]
+	} else {
+		http.Error(w, "Missing ?database= parameter", http.StatusBadRequest)
+		return
+	}
+
+	file := entry.acquireFile()
+	if file == nil {
+		http.Error(w, fmt.Sprintf("database %s not available", entry.name), http.StatusServiceUnavailable)
+		return
+	}
+	defer file.release()
+
+	sum, err := file.checksum()
+	if err != nil {
+		logger.Error("failed to hash database file", "database", entry.name, "error", err)
+		http.Error(w, "Failed to read database file", http.StatusInternalServerError)
+		return
+	}
+
+	// Database files are larger than the server's write timeout allows for
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(httpTimeout)); err != nil {
+		logger.Error("failed to extend write deadline", "operation", "database download", "database", entry.name, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(entry.path)))
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.Header().Set("X-Checksum-SHA256", sum)
+	w.Header().Set("X-Database-Build-Epoch", strconv.FormatUint(uint64(file.buildEpoch), 10))
+	w.Header().Set("X-Database-Type", file.databaseType)
+	buildTime := time.Unix(int64(file.buildEpoch), 0)
+	http.ServeContent(w, r, filepath.Base(entry.path), buildTime, io.NewSectionReader(file.file, 0, file.size))
+}
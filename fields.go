@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fieldsDelimiter separates values in the text output of ?fields= requests.
+var fieldsDelimiter = "|"
+
+// fieldAliases maps short field names onto paths in the full record, so
+// ?fields=country,city gives the same values as the classic endpoints.
+var fieldAliases = map[string]string{
+	"country":      "country.iso_code",
+	"country_name": "country.name",
+	"city":         "city.name",
+	"region":       "subdivisions.0.iso_code",
+	"region_name":  "subdivisions.0.name",
+	"postal":       "postal.code",
+	"continent":    "continent.code",
+	"latitude":     "location.latitude",
+	"longitude":    "location.longitude",
+	"time_zone":    "location.time_zone",
+	"asn":          "traits.autonomous_system_number",
+	"organization": "traits.autonomous_system_organization",
+}
+
+// recordFields lists the top-level keys of a geoRecord that dotted paths may start with.
+var recordFields = map[string]bool{
+	"ip":                  true,
+	"network":             true,
+	"continent":           true,
+	"country":             true,
+	"registered_country":  true,
+	"represented_country": true,
+	"subdivisions":        true,
+	"city":                true,
+	"postal":              true,
+	"location":            true,
+	"traits":              true,
+}
+
+// parseFields validates a comma-separated ?fields= list.
+func parseFields(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		path := field
+		if alias, ok := fieldAliases[field]; ok {
+			path = alias
+		}
+		top, _, _ := strings.Cut(path, ".")
+		if !recordFields[top] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields requested")
+	}
+	return fields, nil
+}
+
+// resolvePath walks a dotted path through decoded JSON. Numeric segments
+// index into arrays. It returns nil when the path does not exist.
+func resolvePath(value interface{}, path string) interface{} {
+	for _, segment := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// selectFields resolves the requested fields against a record, in order.
+// Unknown countries are reported as "XX", as on the classic endpoints.
+func selectFields(rec geoRecord, fields []string) ([]interface{}, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		path := field
+		if alias, ok := fieldAliases[field]; ok {
+			path = alias
+		}
+		values[i] = resolvePath(doc, path)
+		if field == "country" && values[i] == nil {
+			values[i] = "XX"
+		}
+	}
+	return values, nil
+}
+
+// formatFieldValue renders a value for the text output. Missing values are
+// empty; objects and arrays are rendered as compact JSON.
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// respondSelectedFields writes only the fields requested with ?fields=.
+// It returns false, without writing anything, when no fields were requested.
+// JSON output is a flat object keyed by the requested names in request order;
+// text output joins the values with ?delimiter= (default fieldsDelimiter).
+// jsonDefault selects JSON unless ?format=text is given.
+func respondSelectedFields(w http.ResponseWriter, r *http.Request, rec geoRecord, jsonDefault bool) bool {
+	query := r.URL.Query()
+	if !query.Has("fields") {
+		return false
+	}
+
+	fields, err := parseFields(query.Get("fields"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusBadRequest)
+		return true
+	}
+
+	values, err := selectFields(rec, fields)
+	if err != nil {
+		logger.Error("failed to select fields", "ip", rec.IP, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return true
+	}
+
+	format := query.Get("format")
+	if format == "json" || (jsonDefault && format != "text") {
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, field := range fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(field)
+			value, _ := json.Marshal(values[i])
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteString("}\n")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+		return true
+	}
+
+	delimiter := fieldsDelimiter
+	if query.Has("delimiter") {
+		delimiter = query.Get("delimiter")
+	}
+	text := make([]string, len(values))
+	for i, value := range values {
+		text[i] = formatFieldValue(value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, strings.Join(text, delimiter))
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"country", []string{"country"}, false},
+		{"country, city ,asn", []string{"country", "city", "asn"}, false},
+		{"country.names.de,location.latitude", []string{"country.names.de", "location.latitude"}, false},
+		{"subdivisions.0.iso_code", []string{"subdivisions.0.iso_code"}, false},
+		{"ip,network", []string{"ip", "network"}, false},
+		{"country,,city,", []string{"country", "city"}, false},
+		{"", nil, true},
+		{" , ", nil, true},
+		{"bogus", nil, true},
+		{"country,bogus.name", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFields(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFields(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFields(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{
+		"country": {"iso_code": "DE", "names": {"en": "Germany"}},
+		"subdivisions": [{"iso_code": "BE"}, {"iso_code": "XY"}],
+		"traits": {"is_anonymous_proxy": false}
+	}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"country.iso_code", "DE"},
+		{"country.names.en", "Germany"},
+		{"subdivisions.0.iso_code", "BE"},
+		{"subdivisions.1.iso_code", "XY"},
+		{"subdivisions.2.iso_code", nil},
+		{"subdivisions.-1.iso_code", nil},
+		{"subdivisions.first", nil},
+		{"traits.is_anonymous_proxy", false},
+		{"country.iso_code.extra", nil},
+		{"city.name", nil},
+		{"country", map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}}},
+	}
+
+	for _, tt := range tests {
+		if got := resolvePath(doc, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolvePath(%q) = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	rec := geoRecord{
+		IP:           "5.9.0.1",
+		Country:      &countryRecord{ISOCode: "DE", Name: "Germany"},
+		Subdivisions: []subdivisionRecord{{ISOCode: "SN", Name: "Saxony"}},
+		City:         &cityRecord{Name: "Falkenstein"},
+		Location:     &locationRecord{Latitude: 50.4777, Longitude: 12.3649},
+		Traits:       traitsRecord{AutonomousSystemNumber: 24940},
+	}
+
+	tests := []struct {
+		fields []string
+		want   []string
+	}{
+		{[]string{"country", "city", "region"}, []string{"DE", "Falkenstein", "SN"}},
+		{[]string{"latitude", "asn", "ip"}, []string{"50.4777", "24940", "5.9.0.1"}},
+		{[]string{"postal", "organization"}, []string{"", ""}},
+		{[]string{"subdivisions.0"}, []string{`{"iso_code":"SN","name":"Saxony"}`}},
+	}
+
+	for _, tt := range tests {
+		values, err := selectFields(rec, tt.fields)
+		if err != nil {
+			t.Fatalf("selectFields(%v) error = %v", tt.fields, err)
+		}
+		got := make([]string, len(values))
+		for i, v := range values {
+			got[i] = formatFieldValue(v)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("selectFields(%v) = %q, want %q", tt.fields, got, tt.want)
+		}
+	}
+
+	values, err := selectFields(geoRecord{IP: "10.0.0.1"}, []string{"country"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != "XX" {
+		t.Errorf("country of a record without country = %#v, want \"XX\"", values[0])
+	}
+}
@@ -2,9 +2,9 @@ module geoip-api
 
 go 1.21
 
-require github.com/oschwald/geoip2-golang v1.9.0
-
 require (
-	github.com/oschwald/maxminddb-golang v1.12.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
+	github.com/oschwald/geoip2-golang v1.9.0
+	github.com/oschwald/maxminddb-golang v1.12.0
 )
+
+require golang.org/x/sys v0.10.0 // indirect
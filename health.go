@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Readiness thresholds, configured from the environment. Zero disables a check.
+var (
+	healthMaxDatabaseAge  time.Duration // maximum age of a database's build epoch
+	healthMaxFailedUpdate int           // consecutive failed downloads tolerated
+)
+
+// healthCanary is an IP address with the country it is expected to resolve to.
+type healthCanary struct {
+	IP      string `json:"ip"`
+	Country string `json:"country"`
+}
+
+// healthCanaries are looked up on every readiness check. When empty, the
+// check only verifies that a lookup of 8.8.8.8 succeeds.
+var healthCanaries []healthCanary
+
+// parseHealthCanaries parses a comma-separated list of ip=COUNTRY pairs.
+func parseHealthCanaries(value string) ([]healthCanary, error) {
+	var canaries []healthCanary
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ip, country, ok := strings.Cut(pair, "=")
+		ip, country = strings.TrimSpace(ip), strings.ToUpper(strings.TrimSpace(country))
+		if !ok || net.ParseIP(ip) == nil || country == "" {
+			return nil, fmt.Errorf("invalid canary %q, expected ip=COUNTRY", pair)
+		}
+		canaries = append(canaries, healthCanary{IP: ip, Country: country})
+	}
+	return canaries, nil
+}
+
+// healthCheck is the result of one readiness check.
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the detailed readiness report served on /readyz.
+type healthReport struct {
+	Status string        `json:"status"` // "ok" or "fail"
+	Checks []healthCheck `json:"checks"`
+}
+
+// checkReadiness runs all readiness checks. Readers are acquired through the
+// registry so checks never race with a reload closing the old reader.
+func checkReadiness() healthReport {
+	var checks []healthCheck
+	now := time.Now()
+
+	for _, entry := range registry.all() {
+		name := "database:" + entry.name
+
+		buildEpoch, dbType := entry.describe()
+		if dbType == "" {
+			checks = append(checks, healthCheck{Name: name + ":loaded", Message: "database not loaded"})
+			continue
+		}
+		checks = append(checks, healthCheck{Name: name + ":loaded", OK: true, Message: dbType})
+
+		if healthMaxDatabaseAge > 0 {
+			age := now.Sub(time.Unix(int64(buildEpoch), 0))
+			check := healthCheck{Name: name + ":age", OK: age <= healthMaxDatabaseAge,
+				Message: fmt.Sprintf("built %.0f hours ago (maximum %.0f)", age.Hours(), healthMaxDatabaseAge.Hours())}
+			checks = append(checks, check)
+		}
+
+		if healthMaxFailedUpdate > 0 {
+			status := entry.Status()
+			check := healthCheck{Name: name + ":updates", OK: status.ConsecutiveFailures < healthMaxFailedUpdate,
+				Message: fmt.Sprintf("%d consecutive failed updates (not ready at %d)", status.ConsecutiveFailures, healthMaxFailedUpdate)}
+			if status.LastDownloadError != "" {
+				check.Message += ": " + publicUpdateError
+			}
+			checks = append(checks, check)
+		}
+	}
+
+	checks = append(checks, checkCanaries())
+
+	report := healthReport{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "fail"
+			break
+		}
+	}
+	return report
+}
+
+// checkCanaries looks up the canary IPs in the country-capable database and
+// compares the results with the expected countries.
+func checkCanaries() healthCheck {
+	check := healthCheck{Name: "canaries"}
+
+	db, _, unlock, err := getDatabase(kindCity, kindCountry)
+	if err != nil {
+		check.Message = "no country database loaded"
+		return check
+	}
+	defer unlock()
+
+	if len(healthCanaries) == 0 {
+		if _, err := db.Country(net.ParseIP("8.8.8.8")); err != nil {
+			check.Message = fmt.Sprintf("lookup failed: %v", err)
+			return check
+		}
+		check.OK = true
+		check.Message = "lookup succeeded"
+		return check
+	}
+
+	var mismatches []string
+	for _, canary := range healthCanaries {
+		record, err := db.Country(net.ParseIP(canary.IP))
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %v", canary.IP, err))
+			continue
+		}
+		if got := record.Country.IsoCode; got != canary.Country {
+			if got == "" {
+				got = "XX"
+			}
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %s, got %s", canary.IP, canary.Country, got))
+		}
+	}
+	if len(mismatches) > 0 {
+		check.Message = strings.Join(mismatches, "; ")
+		return check
+	}
+	check.OK = true
+	check.Message = fmt.Sprintf("%d canaries matched", len(healthCanaries))
+	return check
+}
+
+// livezHandler reports that the process is running and serving requests.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "OK")
+}
+
+// readyzHandler serves the detailed readiness report as JSON, with status
+// 503 when any check fails.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := checkReadiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthHandler is the original plain-text health check. It now reports
+// readiness, returning the first failed check.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := checkReadiness()
+	for _, check := range report.Checks {
+		if !check.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "ERROR: %s: %s", check.Name, check.Message)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// databaseInfo describes one configured database on /info.
+type databaseInfo struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind,omitempty"`
+	Path      string `json:"path"`
+	EditionID string `json:"edition_id,omitempty"`
+	Loaded    bool   `json:"loaded"`
+
+	DatabaseType string            `json:"database_type,omitempty"`
+	BuildEpoch   uint              `json:"build_epoch,omitempty"`
+	BuildTime    *time.Time        `json:"build_time,omitempty"`
+	IPVersion    uint              `json:"ip_version,omitempty"`
+	NodeCount    uint              `json:"node_count,omitempty"`
+	RecordSize   uint              `json:"record_size,omitempty"`
+	Languages    []string          `json:"languages,omitempty"`
+	Description  map[string]string `json:"description,omitempty"`
+
+	FileModified    *time.Time  `json:"file_modified,omitempty"`
+	FileSize        int64       `json:"file_size,omitempty"`
+	LoadedAt        *time.Time  `json:"loaded_at,omitempty"`
+	UpdateInterval  int         `json:"update_interval_hours"`
+	LastUpdateCheck *time.Time  `json:"last_update_check,omitempty"`
+	NextUpdateCheck *time.Time  `json:"next_update_check,omitempty"`
+	LastUpdate      *updateInfo `json:"last_update,omitempty"`
+	LastReload      *updateInfo `json:"last_reload,omitempty"`
+}
+
+// updateInfo is the outcome of the latest download or reload attempt.
+type updateInfo struct {
+	At      time.Time `json:"at"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// publicUpdateError is reported on the unauthenticated endpoints for a
+// failed update. Upstream errors can carry URLs, hosts and other details of
+// the download setup, so they are only logged.
+const publicUpdateError = "update failed, see the logs for details"
+
+// timePtr returns nil for the zero time, so it is omitted from JSON.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// describeDatabase collects the metadata and update state of an entry.
+func describeDatabase(entry *databaseEntry) databaseInfo {
+	status := entry.Status()
+	info := databaseInfo{
+		Name:            entry.name,
+		Kind:            string(entry.Kind()),
+		Path:            entry.path,
+		EditionID:       entry.editionID,
+		LoadedAt:        timePtr(status.LoadedAt),
+		UpdateInterval:  entry.updateInterval,
+		LastUpdateCheck: timePtr(entry.LastCheck()),
+		NextUpdateCheck: timePtr(status.NextUpdateCheck),
+	}
+
+	if db, unlock, err := entry.acquire(); err == nil {
+		metadata := db.Metadata()
+		unlock()
+
+		buildTime := time.Unix(int64(metadata.BuildEpoch), 0).UTC()
+		info.Loaded = true
+		info.DatabaseType = metadata.DatabaseType
+		info.BuildEpoch = metadata.BuildEpoch
+		info.BuildTime = &buildTime
+		info.IPVersion = metadata.IPVersion
+		info.NodeCount = metadata.NodeCount
+		info.RecordSize = metadata.RecordSize
+		info.Languages = metadata.Languages
+		info.Description = metadata.Description
+	}
+
+	if file := entry.LoadedFile(); file != nil {
+		info.FileModified = timePtr(file.ModTime())
+		info.FileSize = file.Size()
+	}
+	if !status.LastDownloadAt.IsZero() {
+		info.LastUpdate = &updateInfo{At: status.LastDownloadAt, Success: status.LastDownloadError == ""}
+		if !info.LastUpdate.Success {
+			info.LastUpdate.Error = publicUpdateError
+		}
+	}
+	if !status.LastReloadAt.IsZero() {
+		info.LastReload = &updateInfo{At: status.LastReloadAt, Success: status.LastReloadError == "", Error: status.LastReloadError}
+	}
+
+	return info
+}
+
+// infoHandler reports the metadata and update state of every configured
+// database, so replicas can be checked for the data vintage they serve.
+func infoHandler(w http.ResponseWriter, r *http.Request) {
+	entries := registry.all()
+	databases := make([]databaseInfo, 0, len(entries))
+	for _, entry := range entries {
+		databases = append(databases, describeDatabase(entry))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Databases []databaseInfo `json:"databases"`
+	}{databases})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// databaseReader is a GeoIP2 reader that also reads IPinfo databases, whose
+// flat records are converted into the GeoIP2 layout so the lookup endpoints,
+// canaries and health checks treat both the same way.
+type databaseReader struct {
+	*geoip2.Reader
+	ipinfo *maxminddb.Reader // set for IPinfo databases only
+}
+
+// openReader opens an MMDB file for lookups. Besides the types known to
+// geoip2, it accepts IPinfo databases.
+func openReader(path string) (*databaseReader, error) {
+	db, err := geoip2.Open(path)
+	var unknown geoip2.UnknownDatabaseTypeError
+	if errors.As(err, &unknown) && isIPinfoType(unknown.DatabaseType) {
+		raw, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &databaseReader{Reader: db, ipinfo: raw}, nil
+	}
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	return &databaseReader{Reader: db}, nil
+}
+
+// Close closes the reader.
+func (r *databaseReader) Close() error {
+	if r.ipinfo != nil {
+		r.ipinfo.Close()
+	}
+	return r.Reader.Close()
+}
+
+// Metadata returns the metadata of the database. IPinfo databases list no
+// languages, but their names are English.
+func (r *databaseReader) Metadata() maxminddb.Metadata {
+	metadata := r.Reader.Metadata()
+	if r.ipinfo != nil && len(metadata.Languages) == 0 {
+		metadata.Languages = []string{"en"}
+	}
+	return metadata
+}
+
+// providesASN reports whether an IPinfo database also carries ASN data, as
+// IPinfo Lite and the country_asn database do.
+func (r *databaseReader) providesASN() bool {
+	if r.ipinfo == nil {
+		return false
+	}
+	dbType := strings.ToLower(r.ipinfo.Metadata.DatabaseType)
+	return strings.Contains(dbType, "asn") || strings.Contains(dbType, "lite")
+}
+
+// City looks up ip in a City database or an IPinfo database.
+func (r *databaseReader) City(ip net.IP) (*geoip2.City, error) {
+	if r.ipinfo == nil {
+		return r.Reader.City(ip)
+	}
+	var record ipinfoRecord
+	if err := r.ipinfo.Lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	return record.city(), nil
+}
+
+// Country looks up ip in a Country or City database or an IPinfo database.
+func (r *databaseReader) Country(ip net.IP) (*geoip2.Country, error) {
+	if r.ipinfo == nil {
+		return r.Reader.Country(ip)
+	}
+	city, err := r.City(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &geoip2.Country{Continent: city.Continent, Country: city.Country}, nil
+}
+
+// ASN looks up ip in an ASN or ISP database or an IPinfo database.
+func (r *databaseReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	if r.ipinfo == nil {
+		return r.Reader.ASN(ip)
+	}
+	var record ipinfoRecord
+	if err := r.ipinfo.Lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	return &geoip2.ASN{
+		AutonomousSystemNumber:       record.asNumber(),
+		AutonomousSystemOrganization: record.asName(),
+	}, nil
+}
+
+// isIPinfoType reports whether an MMDB database type string belongs to an
+// IPinfo database, e.g. "ipinfo country_asn.mmdb".
+func isIPinfoType(dbType string) bool {
+	return strings.HasPrefix(strings.ToLower(dbType), "ipinfo")
+}
+
+// ipinfoKind classifies an IPinfo database by the product in its type string.
+// IPinfo Lite and the country databases also carry ASN data, which lookups
+// use when no separate ASN database is loaded.
+func ipinfoKind(dbType string) databaseKind {
+	dbType = strings.ToLower(dbType)
+	switch {
+	case strings.Contains(dbType, "location"), strings.Contains(dbType, "city"):
+		return kindCity
+	case strings.Contains(dbType, "country"), strings.Contains(dbType, "lite"):
+		return kindCountry
+	case strings.Contains(dbType, "asn"):
+		return kindASN
+	default:
+		return kindCountry
+	}
+}
+
+// ipinfoRecord is the flat record layout shared by the IPinfo databases. IPinfo
+// Lite stores names in country and continent and their codes in country_code
+// and continent_code; the other databases store codes in country and continent.
+type ipinfoRecord struct {
+	Country       string      `maxminddb:"country"`
+	CountryCode   string      `maxminddb:"country_code"`
+	CountryName   string      `maxminddb:"country_name"`
+	Continent     string      `maxminddb:"continent"`
+	ContinentCode string      `maxminddb:"continent_code"`
+	ContinentName string      `maxminddb:"continent_name"`
+	City          string      `maxminddb:"city"`
+	Region        string      `maxminddb:"region"`
+	RegionCode    string      `maxminddb:"region_code"`
+	PostalCode    string      `maxminddb:"postal_code"`
+	TimeZone      string      `maxminddb:"timezone"`
+	Latitude      interface{} `maxminddb:"lat"` // a string in most IPinfo databases
+	Longitude     interface{} `maxminddb:"lng"`
+	ASN           string      `maxminddb:"asn"` // e.g. "AS15169"
+	ASName        string      `maxminddb:"as_name"`
+	Name          string      `maxminddb:"name"` // AS name in the ASN database
+}
+
+func (r *ipinfoRecord) countryCode() string {
+	if r.CountryCode != "" {
+		return r.CountryCode
+	}
+	if len(r.Country) == 2 {
+		return r.Country
+	}
+	return ""
+}
+
+func (r *ipinfoRecord) countryName() string {
+	if r.CountryCode != "" {
+		return r.Country
+	}
+	return r.CountryName
+}
+
+func (r *ipinfoRecord) asNumber() uint {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(r.ASN), "AS"), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint(asn)
+}
+
+func (r *ipinfoRecord) asName() string {
+	if r.ASName != "" {
+		return r.ASName
+	}
+	return r.Name
+}
+
+// city converts the record into the GeoIP2 City layout, with English names.
+func (r *ipinfoRecord) city() *geoip2.City {
+	var city geoip2.City
+	city.Country.IsoCode = r.countryCode()
+	city.Country.Names = englishNames(r.countryName())
+	if r.ContinentCode != "" {
+		city.Continent.Code = r.ContinentCode
+		city.Continent.Names = englishNames(r.Continent)
+	} else {
+		city.Continent.Code = r.Continent
+		city.Continent.Names = englishNames(r.ContinentName)
+	}
+	city.City.Names = englishNames(r.City)
+	if r.Region != "" {
+		city.Subdivisions = make([]struct {
+			Names     map[string]string `maxminddb:"names"`
+			IsoCode   string            `maxminddb:"iso_code"`
+			GeoNameID uint              `maxminddb:"geoname_id"`
+		}, 1)
+		city.Subdivisions[0].Names = englishNames(r.Region)
+		city.Subdivisions[0].IsoCode = r.RegionCode
+	}
+	city.Postal.Code = r.PostalCode
+	city.Location.TimeZone = r.TimeZone
+	city.Location.Latitude = ipinfoCoordinate(r.Latitude)
+	city.Location.Longitude = ipinfoCoordinate(r.Longitude)
+	return &city
+}
+
+func englishNames(name string) map[string]string {
+	if name == "" {
+		return nil
+	}
+	return map[string]string{"en": name}
+}
+
+// ipinfoCoordinate parses a latitude or longitude, stored as a string or a
+// number depending on the database.
+func ipinfoCoordinate(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
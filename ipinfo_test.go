@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+const (
+	ipinfoLiteFixture     = "testdata/ipinfo_lite.mmdb"
+	ipinfoLocationFixture = "testdata/ipinfo_standard_location.mmdb"
+)
+
+func TestIPinfoReader(t *testing.T) {
+	lite, err := openReader(ipinfoLiteFixture)
+	if err != nil {
+		t.Fatalf("openReader(%s) error = %v", ipinfoLiteFixture, err)
+	}
+	defer lite.Close()
+	location, err := openReader(ipinfoLocationFixture)
+	if err != nil {
+		t.Fatalf("openReader(%s) error = %v", ipinfoLocationFixture, err)
+	}
+	defer location.Close()
+
+	if kind := detectDatabaseKind(lite); kind != kindCountry {
+		t.Errorf("IPinfo Lite kind = %s, want %s", kind, kindCountry)
+	}
+	if kind := detectDatabaseKind(location); kind != kindCity {
+		t.Errorf("IPinfo location kind = %s, want %s", kind, kindCity)
+	}
+	if !lite.providesASN() || location.providesASN() {
+		t.Errorf("providesASN() = %v (Lite), %v (location), want true, false", lite.providesASN(), location.providesASN())
+	}
+	if languages := lite.Metadata().Languages; !reflect.DeepEqual(languages, []string{"en"}) {
+		t.Errorf("Metadata().Languages = %q, want [en]", languages)
+	}
+
+	ip := net.ParseIP("5.9.1.1")
+	country, err := lite.Country(ip)
+	if err != nil {
+		t.Fatalf("Country() error = %v", err)
+	}
+	if country.Country.IsoCode != "DE" || country.Country.Names["en"] != "Germany" || country.Continent.Code != "EU" || country.Continent.Names["en"] != "Europe" {
+		t.Errorf("Country() = %+v, want Germany (DE) in Europe (EU)", country)
+	}
+	asn, err := lite.ASN(ip)
+	if err != nil {
+		t.Fatalf("ASN() error = %v", err)
+	}
+	if asn.AutonomousSystemNumber != 24940 || asn.AutonomousSystemOrganization != "Hetzner Online GmbH" {
+		t.Errorf("ASN() = %+v, want AS24940 Hetzner Online GmbH", asn)
+	}
+
+	city, err := location.City(net.ParseIP("8.8.8.8"))
+	if err != nil {
+		t.Fatalf("City() error = %v", err)
+	}
+	rec := newGeoRecord("8.8.8.8", city, []string{"en"})
+	if rec.Country == nil || rec.Country.ISOCode != "US" {
+		t.Errorf("country = %+v, want US", rec.Country)
+	}
+	if rec.City == nil || rec.City.Name != "Mountain View" {
+		t.Errorf("city = %+v, want Mountain View", rec.City)
+	}
+	if len(rec.Subdivisions) != 1 || rec.Subdivisions[0].ISOCode != "CA" || rec.Subdivisions[0].Name != "California" {
+		t.Errorf("subdivisions = %+v, want California (CA)", rec.Subdivisions)
+	}
+	if rec.Postal == nil || rec.Postal.Code != "94043" {
+		t.Errorf("postal = %+v, want 94043", rec.Postal)
+	}
+	if rec.Location == nil || rec.Location.Latitude != 37.40599 || rec.Location.Longitude != -122.07851 || rec.Location.TimeZone != "America/Los_Angeles" {
+		t.Errorf("location = %+v, want 37.40599,-122.07851 in America/Los_Angeles", rec.Location)
+	}
+}
+
+func TestIPinfoLookupSession(t *testing.T) {
+	defer func(entries []*databaseEntry) { registry.entries = entries }(registry.entries)
+
+	entry := &databaseEntry{name: "country", path: ipinfoLiteFixture}
+	if err := reloadDatabase(entry); err != nil {
+		t.Fatal(err)
+	}
+	defer entry.close()
+	registry.entries = []*databaseEntry{entry}
+
+	session := newLookupSession()
+	defer session.close()
+	if session.asn == nil {
+		t.Fatal("session has no ASN database, want the IPinfo Lite database")
+	}
+	rec := session.record(net.ParseIP("8.8.8.8"))
+	if rec.Country == nil || rec.Country.ISOCode != "US" || rec.Country.Name != "United States" {
+		t.Errorf("country = %+v, want United States (US)", rec.Country)
+	}
+	if rec.Traits.AutonomousSystemNumber != 15169 || rec.Traits.AutonomousSystemOrganization != "Google LLC" {
+		t.Errorf("ASN = %d %q, want 15169 Google LLC", rec.Traits.AutonomousSystemNumber, rec.Traits.AutonomousSystemOrganization)
+	}
+}
+
+func TestIPinfoEditionAndDiff(t *testing.T) {
+	if editionID, ok := editionFromFile(ipinfoLiteFixture); !ok || editionID != "ipinfo_lite" {
+		t.Errorf("editionFromFile() = %q, %v, want ipinfo_lite", editionID, ok)
+	}
+
+	// The same countries decoded from both layouts compare as unchanged
+	diff, err := diffDatabaseFiles(diffOldFixture, ipinfoLiteFixture)
+	if err != nil {
+		t.Fatalf("diffDatabaseFiles() error = %v", err)
+	}
+	got := [5]int{diff.OldNetworks, diff.NewNetworks, diff.ChangedNetworks, diff.AddedNetworks, diff.RemovedNetworks}
+	if want := [5]int{5, 3, 0, 0, 2}; got != want {
+		t.Errorf("diff counts (old, new, changed, added, removed) = %v, want %v", got, want)
+	}
+}
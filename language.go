@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageFallback is appended to every negotiated language list, so names
+// are still returned when none of the requested languages are available.
+var languageFallback = []string{"en"}
+
+// parseLanguageList splits a comma-separated language list, dropping blanks.
+func parseLanguageList(value string) []string {
+	var languages []string
+	for _, lang := range strings.Split(value, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header
+// ordered by quality, ignoring the "*" wildcard and q=0 entries.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		lang    string
+		quality float64
+	}
+
+	var entries []weighted
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang = strings.TrimSpace(lang)
+		if lang == "" || lang == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = v
+			}
+		}
+		if quality > 0 {
+			entries = append(entries, weighted{lang, quality})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].quality > entries[j].quality
+	})
+
+	languages := make([]string, len(entries))
+	for i, entry := range entries {
+		languages[i] = entry.lang
+	}
+	return languages
+}
+
+// matchLanguage maps a requested language tag onto one the database supports:
+// an exact (case-insensitive) match first, then a match on the primary
+// subtag, so "zh" and "zh-TW" resolve to "zh-CN" and "pt" to "pt-BR".
+func matchLanguage(lang string, supported []string) (string, bool) {
+	for _, s := range supported {
+		if strings.EqualFold(lang, s) {
+			return s, true
+		}
+	}
+
+	base, _, _ := strings.Cut(lang, "-")
+	for _, s := range supported {
+		sBase, _, _ := strings.Cut(s, "-")
+		if strings.EqualFold(base, sBase) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// negotiateLanguages resolves the languages for a request against the ones
+// the database supports. The ?lang= parameter (comma-separated) takes
+// precedence over Accept-Language, and the configured fallback chain is
+// always appended. Explicitly requested languages that cannot be served
+// are returned as unsupported.
+func negotiateLanguages(r *http.Request, supported []string) (languages, unsupported []string) {
+	requested := parseLanguageList(r.URL.Query().Get("lang"))
+	explicit := len(requested) > 0
+	if !explicit {
+		requested = parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	}
+
+	seen := make(map[string]bool)
+	add := func(lang string) bool {
+		match, ok := matchLanguage(lang, supported)
+		if !ok {
+			return false
+		}
+		if !seen[match] {
+			seen[match] = true
+			languages = append(languages, match)
+		}
+		return true
+	}
+
+	for _, lang := range requested {
+		if !add(lang) && explicit {
+			unsupported = append(unsupported, lang)
+		}
+	}
+	for _, lang := range languageFallback {
+		add(lang)
+	}
+	return languages, unsupported
+}
+
+// localizedName returns the first name available in the given languages.
+func localizedName(names map[string]string, languages []string) string {
+	for _, lang := range languages {
+		if name, ok := names[lang]; ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var testSupportedLanguages = []string{"de", "en", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"fr;q=0.5, de, en;q=0.8", []string{"de", "en", "fr"}},
+		{"de;q=0.5, fr;q=0.5", []string{"de", "fr"}},
+		{"*, ja;q=0.1", []string{"ja"}},
+		{"de;q=0, en", []string{"en"}},
+		{"de;q=bogus, en;q=0.9", []string{"de", "en"}},
+		{" , ,es ", []string{"es"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAcceptLanguage(%q) = %#v, want %#v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateLanguages(t *testing.T) {
+	tests := []struct {
+		name            string
+		query           string
+		acceptLanguage  string
+		fallback        []string
+		wantLanguages   []string
+		wantUnsupported []string
+	}{
+		{
+			name:          "nothing requested",
+			fallback:      []string{"en"},
+			wantLanguages: []string{"en"},
+		},
+		{
+			name:           "accept-language ordered by quality",
+			acceptLanguage: "fr;q=0.7, de",
+			fallback:       []string{"en"},
+			wantLanguages:  []string{"de", "fr", "en"},
+		},
+		{
+			name:           "query takes precedence",
+			query:          "?lang=ja",
+			acceptLanguage: "de",
+			fallback:       []string{"en"},
+			wantLanguages:  []string{"ja", "en"},
+		},
+		{
+			name:          "primary subtag match",
+			query:         "?lang=zh-TW,pt",
+			fallback:      []string{"en"},
+			wantLanguages: []string{"zh-CN", "pt-BR", "en"},
+		},
+		{
+			name:          "case insensitive",
+			query:         "?lang=PT-br",
+			fallback:      []string{"en"},
+			wantLanguages: []string{"pt-BR", "en"},
+		},
+		{
+			name:            "unsupported explicit language",
+			query:           "?lang=xx,de",
+			fallback:        []string{"en"},
+			wantLanguages:   []string{"de", "en"},
+			wantUnsupported: []string{"xx"},
+		},
+		{
+			name:           "unsupported accept-language is ignored",
+			acceptLanguage: "xx, de;q=0.5",
+			fallback:       []string{"en"},
+			wantLanguages:  []string{"de", "en"},
+		},
+		{
+			name:          "duplicates collapse",
+			query:         "?lang=en,de,en-GB",
+			fallback:      []string{"de", "en"},
+			wantLanguages: []string{"en", "de"},
+		},
+		{
+			name:          "fallback chain",
+			query:         "?lang=ru",
+			fallback:      []string{"es", "xx", "en"},
+			wantLanguages: []string{"ru", "es", "en"},
+		},
+	}
+
+	defer func(fallback []string) { languageFallback = fallback }(languageFallback)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			languageFallback = tt.fallback
+			r := httptest.NewRequest("GET", "/city/8.8.8.8"+tt.query, nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			languages, unsupported := negotiateLanguages(r, testSupportedLanguages)
+			if !reflect.DeepEqual(languages, tt.wantLanguages) {
+				t.Errorf("languages = %#v, want %#v", languages, tt.wantLanguages)
+			}
+			if !reflect.DeepEqual(unsupported, tt.wantUnsupported) {
+				t.Errorf("unsupported = %#v, want %#v", unsupported, tt.wantUnsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// sharedVolume enables coordination between replicas that share the
+	// database directory: only the replica holding a database's update lock
+	// checks upstream and downloads, the others reload the file it wrote.
+	sharedVolume bool
+
+	// updateLockTimeout is the age after which a lock is considered
+	// abandoned, e.g. because its holder crashed, and is taken over.
+	updateLockTimeout = 30 * time.Minute
+
+	// lockRetryInterval is how long a replica waits before looking at a
+	// database again while another replica holds its update lock.
+	lockRetryInterval = time.Minute
+
+	// lockSettleDelay is how long a replica waits after taking over an
+	// abandoned lock before checking that no other replica took it over too.
+	lockSettleDelay = time.Second
+)
+
+// sharedFileMode is the mode of the lock and state files, which replicas
+// running under other UIDs must be able to read.
+const sharedFileMode = 0644
+
+// errUpdateLocked is returned by updateDatabase when another replica holds
+// the database's update lock.
+var errUpdateLocked = errors.New("another replica is updating the database")
+
+// updateLock is an exclusive lock file next to a database on a shared volume.
+type updateLock struct {
+	path   string
+	holder lockHolder
+}
+
+// lockHolder identifies the replica holding a lock. The acquisition time is
+// stored in the file rather than taken from its mtime, which shared file
+// systems do not always keep.
+type lockHolder struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// lockPath returns the path of the update lock of the database at dbPath.
+func lockPath(dbPath string) string {
+	return dbPath + ".lock"
+}
+
+// lockHolderName identifies this replica in lock files.
+func lockHolderName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+// acquireUpdateLock takes the update lock of the database at dbPath. It
+// returns false, without an error, when another replica holds the lock. A
+// lock older than updateLockTimeout is taken over.
+func acquireUpdateLock(dbPath string) (*updateLock, bool, error) {
+	path := lockPath(dbPath)
+	holder := lockHolder{Holder: lockHolderName(), AcquiredAt: time.Now().UTC()}
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Write the holder to a temporary file and link it into place, so the
+	// lock appears atomically with its contents, also on NFS
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create lock file %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, writeErr := tmp.Write(data)
+	if err := errors.Join(writeErr, tmp.Close(), os.Chmod(tmp.Name(), sharedFileMode)); err != nil {
+		return nil, false, fmt.Errorf("failed to write lock file %s: %w", path, err)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmp.Name(), path)
+		if err == nil {
+			return &updateLock{path: path, holder: holder}, true, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, false, fmt.Errorf("failed to create lock file %s: %w", path, err)
+		}
+
+		current, err := readLockHolder(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue // released in the meantime
+		case err != nil:
+			logger.Warn("taking over unreadable update lock", "path", path, "error", err)
+		case time.Since(current.AcquiredAt) < updateLockTimeout:
+			logger.Debug("update lock held by another replica", "path", path, "holder", current.Holder, "acquired_at", current.AcquiredAt.Format(time.RFC3339))
+			return nil, false, nil
+		default:
+			// An abandoned lock, e.g. its holder crashed
+			logger.Warn("taking over abandoned update lock", "path", path, "holder", current.Holder, "acquired_at", current.AcquiredAt.Format(time.RFC3339))
+		}
+		return takeOverUpdateLock(path, tmp.Name(), holder)
+	}
+	return nil, false, nil
+}
+
+// takeOverUpdateLock replaces an abandoned lock file with the one at tmp.
+// Renaming over the lock keeps it in place throughout, but replicas taking
+// over the same lock at once all succeed in renaming, so after
+// lockSettleDelay only the replica whose holder is left in the file owns it.
+func takeOverUpdateLock(path, tmp string, holder lockHolder) (*updateLock, bool, error) {
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, false, fmt.Errorf("failed to take over lock file %s: %w", path, err)
+	}
+	time.Sleep(lockSettleDelay)
+
+	current, err := readLockHolder(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil // taken over and released by another replica
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	if !current.equal(holder) {
+		logger.Debug("update lock taken over by another replica at the same time", "path", path, "holder", current.Holder)
+		return nil, false, nil
+	}
+	return &updateLock{path: path, holder: holder}, true, nil
+}
+
+// readLockHolder reads the holder of a lock file.
+func readLockHolder(path string) (lockHolder, error) {
+	var holder lockHolder
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(data, &holder)
+	return holder, err
+}
+
+// equal reports whether two holders describe the same acquisition.
+func (h lockHolder) equal(other lockHolder) bool {
+	return h.Holder == other.Holder && h.AcquiredAt.Equal(other.AcquiredAt)
+}
+
+// release removes the lock file, unless another replica took it over in the
+// meantime.
+func (l *updateLock) release() {
+	if current, err := readLockHolder(l.path); err != nil || !current.equal(l.holder) {
+		logger.Error("update lock was taken over by another replica", "path", l.path)
+		return
+	}
+	if err := os.Remove(l.path); err != nil {
+		logger.Error("failed to release update lock", "path", l.path, "error", err)
+	}
+}
+
+// waitForUpdateLock blocks until the update lock of the entry's database is
+// acquired. Used on startup, so replicas starting together wait for the one
+// downloading instead of downloading as well.
+func waitForUpdateLock(entry *databaseEntry) (*updateLock, error) {
+	for waited := false; ; waited = true {
+		lock, ok, err := acquireUpdateLock(entry.path)
+		if err != nil || ok {
+			return lock, err
+		}
+		if !waited {
+			logger.Info("waiting for another replica to finish updating", "database", entry.name)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// reloadIfReplaced reloads the entry when the file on disk is not the one it
+// loaded, e.g. because another replica downloaded a newer build. The caller
+// must hold entry.updateMu.
+func reloadIfReplaced(entry *databaseEntry) {
+	info, err := os.Stat(entry.path)
+	if err != nil {
+		return
+	}
+	if loaded := entry.LoadedFile(); loaded != nil && sameFileVersion(info, loaded) {
+		return
+	}
+	logger.Info("database file replaced by another replica, reloading", "database", entry.name, "path", entry.path)
+	if err := reloadDatabase(entry); err != nil {
+		logger.Error("database reload failed", "database", entry.name, "path", entry.path, "reason", "replaced by another replica", "error", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeLockFile(t *testing.T, path string, holder lockHolder) {
+	t.Helper()
+	data, err := json.Marshal(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, sharedFileMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireUpdateLock(t *testing.T) {
+	defer func(delay time.Duration) { lockSettleDelay = delay }(lockSettleDelay)
+	lockSettleDelay = 10 * time.Millisecond
+
+	other := "other-replica/1"
+	tests := []struct {
+		name     string
+		existing func(t *testing.T, path string)
+		wantOK   bool
+	}{
+		{
+			name:   "no lock",
+			wantOK: true,
+		},
+		{
+			name: "held by another replica",
+			existing: func(t *testing.T, path string) {
+				writeLockFile(t, path, lockHolder{Holder: other, AcquiredAt: time.Now().Add(-time.Minute)})
+			},
+		},
+		{
+			name: "abandoned",
+			existing: func(t *testing.T, path string) {
+				writeLockFile(t, path, lockHolder{Holder: other, AcquiredAt: time.Now().Add(-updateLockTimeout - time.Minute)})
+			},
+			wantOK: true,
+		},
+		{
+			name: "unreadable",
+			existing: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("{"), sharedFileMode); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+			if tt.existing != nil {
+				tt.existing(t, lockPath(dbPath))
+			}
+
+			lock, ok, err := acquireUpdateLock(dbPath)
+			if err != nil {
+				t.Fatalf("acquireUpdateLock() error = %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("acquireUpdateLock() ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			holder, err := readLockHolder(lockPath(dbPath))
+			if err != nil {
+				t.Fatalf("readLockHolder() error = %v", err)
+			}
+			if !ok {
+				if holder.Holder != other {
+					t.Errorf("lock holder = %q, want %q", holder.Holder, other)
+				}
+				return
+			}
+			if !holder.equal(lock.holder) {
+				t.Errorf("lock holder = %+v, want %+v", holder, lock.holder)
+			}
+			if info, err := os.Stat(lockPath(dbPath)); err != nil || info.Mode().Perm() != sharedFileMode {
+				t.Errorf("lock file mode = %v (%v), want %v", info.Mode().Perm(), err, os.FileMode(sharedFileMode))
+			}
+
+			lock.release()
+			if _, err := os.Stat(lockPath(dbPath)); !os.IsNotExist(err) {
+				t.Errorf("lock file still exists after release: %v", err)
+			}
+			if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dbPath), ".tmp-*")); len(matches) > 0 {
+				t.Errorf("temporary files left behind: %v", matches)
+			}
+		})
+	}
+}
+
+func TestUpdateLockReleaseAfterTakeover(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	lock, ok, err := acquireUpdateLock(dbPath)
+	if err != nil || !ok {
+		t.Fatalf("acquireUpdateLock() = %v, %v", ok, err)
+	}
+
+	// Another replica took the lock over, e.g. because this one stalled
+	writeLockFile(t, lockPath(dbPath), lockHolder{Holder: "other-replica/1", AcquiredAt: time.Now()})
+	lock.release()
+
+	if holder, err := readLockHolder(lockPath(dbPath)); err != nil || holder.Holder != "other-replica/1" {
+		t.Errorf("lock of the other replica was released: %+v, %v", holder, err)
+	}
+}
+
+func TestTakeOverUpdateLockConcurrently(t *testing.T) {
+	defer func(delay time.Duration) { lockSettleDelay = delay }(lockSettleDelay)
+	lockSettleDelay = 50 * time.Millisecond
+
+	for round := 0; round < 10; round++ {
+		dbPath := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+		writeLockFile(t, lockPath(dbPath), lockHolder{Holder: "crashed-replica/1", AcquiredAt: time.Now().Add(-2 * updateLockTimeout)})
+
+		const replicas = 8
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			winners int
+		)
+		for i := 0; i < replicas; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, ok, err := acquireUpdateLock(dbPath)
+				if err != nil {
+					t.Errorf("acquireUpdateLock() error = %v", err)
+					return
+				}
+				if ok {
+					mu.Lock()
+					winners++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if winners != 1 {
+			t.Fatalf("round %d: %d replicas took over the lock, want 1", round, winners)
+		}
+	}
+}
+
+func TestUpdateDatabaseLockError(t *testing.T) {
+	defer func(shared bool) { sharedVolume = shared }(sharedVolume)
+	sharedVolume = true
+
+	// The lock cannot be created in a missing directory
+	dir := t.TempDir()
+	entry := &databaseEntry{name: "city", path: filepath.Join(dir, "missing", "GeoLite2-City.mmdb"), editionID: "GeoLite2-City", updateInterval: 24}
+	source := &localSource{path: filepath.Join(dir, "source")}
+
+	if err := updateDatabase(source, entry, false); err == nil {
+		t.Fatal("updateDatabase() succeeded")
+	}
+	if due := entry.updateDue(); !due.After(time.Now()) {
+		t.Errorf("updateDue() = %s after a failed update, want a retry in the future", due)
+	}
+	if failures := entry.Status().ConsecutiveFailures; failures != 1 {
+		t.Errorf("ConsecutiveFailures = %d, want 1", failures)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	logLevel = new(slog.LevelVar) // Info by default
+	logger   = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	// accessLogEnabled controls the per-request access log
+	accessLogEnabled = true
+)
+
+// configureLogging selects the log format ("logfmt" or "json") and level
+// ("ERROR", "INFO" or "DEBUG"). The standard library logger is redirected
+// so that messages from net/http are structured as well.
+func configureLogging(format, level string) error {
+	var levelErr error
+	switch strings.ToUpper(level) {
+	case "ERROR":
+		logLevel.Set(slog.LevelError)
+	case "DEBUG":
+		logLevel.Set(slog.LevelDebug)
+	case "INFO", "":
+		logLevel.Set(slog.LevelInfo)
+	default:
+		logLevel.Set(slog.LevelInfo)
+		levelErr = fmt.Errorf("unknown LOG_LEVEL '%s', defaulting to INFO", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, options))
+	case "logfmt", "text", "":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, options))
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT '%s', expected json or logfmt", format)
+	}
+	slog.SetDefault(logger)
+	log.SetFlags(0)
+
+	return levelErr
+}
+
+// logFatal logs an error with key/value attributes and exits the process.
+func logFatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// accessLogKey is the context key of the per-request accessLogEntry.
+type accessLogKey struct{}
+
+// accessLogEntry collects details that handlers add to the access log.
+type accessLogEntry struct {
+	country string
+}
+
+// setLogCountry records the looked-up country for the request's access log.
+func setLogCountry(r *http.Request, country string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.country = country
+	}
+}
+
+// newRequestID returns a random 16-character hex identifier.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// accessLogHandler assigns each request an ID (reusing a valid incoming
+// X-Request-ID), echoes it in the response, and logs one access log line
+// per request.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		if !accessLogEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &accessLogEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("request_id", requestID),
+		}
+		if ip, err := clientIP(r); err == nil {
+			attrs = append(attrs, slog.String("client_ip", ip.String()))
+		}
+		if entry.country != "" {
+			attrs = append(attrs, slog.String("country", entry.country))
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
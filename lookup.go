@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// Default maximum number of IPs accepted by a single batch request
+	defaultMaxBatchSize = 1000
+	// Upper bound on request body bytes per batch item (IPv6 text plus JSON quoting)
+	maxBatchItemBytes = 64
+)
+
+// maxBatchSize is the configured maximum number of IPs per batch request.
+var maxBatchSize = defaultMaxBatchSize
+
+// lookupResult holds the data resolved for a single IP across the loaded databases.
+type lookupResult struct {
+	Network      string `json:"network,omitempty"`
+	Country      string `json:"country"`
+	CountryName  string `json:"country_name,omitempty"`
+	City         string `json:"city,omitempty"`
+	Region       string `json:"region,omitempty"`
+	RegionName   string `json:"region_name,omitempty"`
+	ASN          uint   `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// batchLookupItem is one entry of a batch response. The embedded result is
+// nil when the input could not be looked up, in which case Error is set.
+type batchLookupItem struct {
+	IP    string `json:"ip"`
+	Error string `json:"error,omitempty"`
+	*lookupResult
+}
+
+// lookupSession holds read locks on the best loaded databases for the
+// duration of one request, so batches pay the locking cost only once.
+type lookupSession struct {
+	geo            *databaseReader
+	geoKind        databaseKind
+	asn            *databaseReader
+	anonymousIP    *databaseReader
+	connectionType *databaseReader
+	networks       []*maxminddb.Reader // same files as above, for network lookups
+	languages      []string            // preferred languages for name fields
+	unlocks        []func()
+}
+
+// newLookupSession acquires the best country-capable database and, if loaded,
+// the ASN, Anonymous-IP and Connection-Type databases. Without an ASN
+// database, an IPinfo geo database carrying ASN data is used for it.
+// The caller must call close when done.
+func newLookupSession() *lookupSession {
+	s := &lookupSession{languages: languageFallback}
+	s.geo, s.geoKind = s.acquire(kindCity, kindCountry)
+	s.asn, _ = s.acquire(kindASN)
+	if s.asn == nil && s.geo != nil && s.geo.providesASN() {
+		s.asn = s.geo
+	}
+	s.anonymousIP, _ = s.acquire(kindAnonymousIP)
+	s.connectionType, _ = s.acquire(kindConnectionType)
+	return s
+}
+
+// acquire read-locks the best loaded database of the given kinds for the
+// session and returns its reader, or nil when none is loaded.
+func (s *lookupSession) acquire(kinds ...databaseKind) (*databaseReader, databaseKind) {
+	entry := registry.find(kinds...)
+	if entry == nil {
+		return nil, ""
+	}
+	db, unlock, err := entry.acquire()
+	if err != nil {
+		return nil, ""
+	}
+	s.unlocks = append(s.unlocks, unlock)
+	if networks := entry.networkReader(); networks != nil {
+		s.networks = append(s.networks, networks)
+	}
+	return db, entry.Kind()
+}
+
+// negotiate selects the name languages for r from the ones the geo database
+// supports and reports them in the Content-Language header. Explicitly
+// requested but unsupported languages are listed in X-Unsupported-Languages;
+// if none of the requested languages are supported, a 400 error is written
+// and false is returned.
+func (s *lookupSession) negotiate(w http.ResponseWriter, r *http.Request) bool {
+	if s.geo == nil {
+		return true
+	}
+
+	supported := s.geo.Metadata().Languages
+	languages, unsupported := negotiateLanguages(r, supported)
+	if len(unsupported) > 0 {
+		requested := parseLanguageList(r.URL.Query().Get("lang"))
+		if len(unsupported) == len(requested) {
+			http.Error(w, fmt.Sprintf("Unsupported language: %s (supported: %s)", strings.Join(unsupported, ", "), strings.Join(supported, ", ")), http.StatusBadRequest)
+			return false
+		}
+		w.Header().Set("X-Unsupported-Languages", strings.Join(unsupported, ", "))
+	}
+
+	s.languages = languages
+	if len(languages) > 0 {
+		w.Header().Set("Content-Language", languages[0])
+	}
+	return true
+}
+
+// openLookupSession starts a lookup session for a request and negotiates its
+// languages. It writes an error response and returns false when no geo
+// database is loaded or the requested language is unsupported.
+func openLookupSession(w http.ResponseWriter, r *http.Request) (*lookupSession, bool) {
+	session := newLookupSession()
+	if session.geo == nil {
+		session.close()
+		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if !session.negotiate(w, r) {
+		session.close()
+		return nil, false
+	}
+	return session, true
+}
+
+// close releases all database locks held by the session.
+func (s *lookupSession) close() {
+	for _, unlock := range s.unlocks {
+		unlock()
+	}
+	s.unlocks = nil
+}
+
+// record resolves ip against every database held by the session.
+func (s *lookupSession) record(ip net.IP) geoRecord {
+	var rec geoRecord
+
+	switch s.geoKind {
+	case kindCity:
+		record, err := s.geo.City(ip)
+		if err != nil {
+			logger.Debug("IP lookup failed", "ip", ip.String(), "error", err)
+			break
+		}
+		rec = newGeoRecord(ip.String(), record, s.languages)
+	case kindCountry:
+		record, err := s.geo.Country(ip)
+		if err != nil {
+			logger.Debug("IP lookup failed", "ip", ip.String(), "error", err)
+			break
+		}
+		rec = newGeoRecord(ip.String(), countryAsCity(record), s.languages)
+	}
+	rec.IP = ip.String()
+	if s.geo != nil {
+		metrics.observeLookup(rec.Country != nil)
+	}
+
+	if s.asn != nil {
+		record, err := s.asn.ASN(ip)
+		if err != nil {
+			logger.Debug("ASN lookup failed", "ip", ip.String(), "error", err)
+		} else {
+			rec.Traits.AutonomousSystemNumber = record.AutonomousSystemNumber
+			rec.Traits.AutonomousSystemOrganization = record.AutonomousSystemOrganization
+		}
+	}
+
+	if s.anonymousIP != nil {
+		record, err := s.anonymousIP.AnonymousIP(ip)
+		if err != nil {
+			logger.Debug("Anonymous-IP lookup failed", "ip", ip.String(), "error", err)
+		} else {
+			rec.Traits.IsAnonymous = record.IsAnonymous
+			rec.Traits.IsAnonymousVPN = record.IsAnonymousVPN
+			rec.Traits.IsHostingProvider = record.IsHostingProvider
+			rec.Traits.IsPublicProxy = record.IsPublicProxy
+			rec.Traits.IsResidentialProxy = record.IsResidentialProxy
+			rec.Traits.IsTorExitNode = record.IsTorExitNode
+		}
+	}
+
+	if s.connectionType != nil {
+		record, err := s.connectionType.ConnectionType(ip)
+		if err != nil {
+			logger.Debug("Connection-Type lookup failed", "ip", ip.String(), "error", err)
+		} else {
+			rec.Traits.ConnectionType = record.ConnectionType
+		}
+	}
+
+	if network := s.network(ip); network != nil {
+		rec.Network = network.String()
+	}
+
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		result := rec.summary()
+		logger.Debug("ip lookup", "ip", rec.IP, "network", rec.Network, "country", result.Country, "city", result.City, "region", result.Region, "asn", result.ASN)
+	}
+	return rec
+}
+
+// network returns the most specific network containing ip across the
+// session's databases. Every database has a single record for all of its
+// addresses, so the whole lookup result is the same for them and can be
+// cached or acted upon per network. It returns nil when no database is held.
+func (s *lookupSession) network(ip net.IP) *net.IPNet {
+	var network *net.IPNet
+	for _, reader := range s.networks {
+		n, err := lookupNetwork(reader, ip)
+		if err != nil {
+			logger.Debug("network lookup failed", "ip", ip.String(), "error", err)
+			continue
+		}
+		if network == nil || hostBits(n) < hostBits(network) {
+			network = n
+		}
+	}
+	return network
+}
+
+// lookupNetwork returns the network of the record ip belongs to in reader,
+// or of the largest surrounding block without data if there is no record.
+func lookupNetwork(reader *maxminddb.Reader, ip net.IP) (*net.IPNet, error) {
+	var record struct{} // only the network is needed
+	network, _, err := reader.LookupNetwork(ip, &record)
+	return network, err
+}
+
+// hostBits returns the number of address bits not covered by the prefix.
+func hostBits(network *net.IPNet) int {
+	ones, bits := network.Mask.Size()
+	return bits - ones
+}
+
+// lookup resolves ip to the fields served by the classic endpoints.
+// Unknown countries are reported as "XX".
+func (s *lookupSession) lookup(ip net.IP) lookupResult {
+	rec := s.record(ip)
+	return rec.summary()
+}
+
+// parseBatchInput reads IPs from a JSON array of strings or from
+// newline-delimited text. Blank lines are ignored.
+func parseBatchInput(body []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var ips []string
+		if err := json.Unmarshal(trimmed, &ips); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return ips, nil
+	}
+
+	var ips []string
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ips = append(ips, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// batchLookupHandler resolves many IPs in one request. Results keep the
+// input order and invalid IPs are reported per item.
+func batchLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Usage: POST /lookup with a JSON array or newline-delimited list of IPs", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBatchSize*maxBatchItemBytes+1024)))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ips, err := parseBatchInput(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(ips) == 0 {
+		http.Error(w, "No IP addresses provided", http.StatusBadRequest)
+		return
+	}
+	if len(ips) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Too many IP addresses: %d (maximum %d)", len(ips), maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	session, ok := openLookupSession(w, r)
+	if !ok {
+		return
+	}
+	defer session.close()
+
+	items := make([]batchLookupItem, len(ips))
+	for i, ipStr := range ips {
+		items[i].IP = ipStr
+		ip := net.ParseIP(strings.TrimSpace(ipStr))
+		if ip == nil {
+			items[i].Error = "invalid IP address"
+			continue
+		}
+		result := session.lookup(ip)
+		items[i].lookupResult = &result
+	}
+
+	logger.Debug("batch lookup resolved", "ips", len(items))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
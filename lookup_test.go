@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBatchInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{"json array", `["8.8.8.8", "1.1.1.1"]`, []string{"8.8.8.8", "1.1.1.1"}, false},
+		{"json array with whitespace", "\n  [\"2001:4860::1\"]  \n", []string{"2001:4860::1"}, false},
+		{"empty json array", `[]`, []string{}, false},
+		{"invalid json", `["8.8.8.8",`, nil, true},
+		{"json with non-strings", `[8, 8]`, nil, true},
+		{"newline delimited", "8.8.8.8\n1.1.1.1\n", []string{"8.8.8.8", "1.1.1.1"}, false},
+		{"crlf and blank lines", "8.8.8.8\r\n\r\n  1.1.1.1  \r\n", []string{"8.8.8.8", "1.1.1.1"}, false},
+		{"invalid items are kept", "8.8.8.8\nnot-an-ip", []string{"8.8.8.8", "not-an-ip"}, false},
+		{"empty body", "", nil, false},
+		{"whitespace only", " \n\t\n", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBatchInput([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBatchInput(%q) error = %v, wantErr %v", tt.body, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBatchInput(%q) = %#v, want %#v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,31 +2,29 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/oschwald/geoip2-golang"
 )
 
 const (
-	// Maximum size for downloaded database file (100MB)
-	maxDownloadSize = 100 * 1024 * 1024
+	// Maximum size of an extracted database file (1GB)
+	maxExtractedSize = 1024 * 1024 * 1024
 	// HTTP client timeout for downloads
 	httpTimeout = 5 * time.Minute
 	// HTTP server timeouts to prevent slowloris attacks
@@ -37,187 +35,174 @@ const (
 	shutdownTimeout = 30 * time.Second
 )
 
-var (
-	dbValue  atomic.Value   // stores *geoip2.Reader
-	isCityDB atomic.Bool    // tracks if database is City (true) or Country (false)
-	dbMutex  = &sync.RWMutex{} // Mutex to protect DB access during reloads
-)
-
-// Log levels
-const (
-	LogLevelError = iota
-	LogLevelInfo
-	LogLevelDebug
-)
+// verifyChecksums controls whether downloads are checked against the
+// published .sha256 file.
+var verifyChecksums = true
 
-var currentLogLevel = LogLevelInfo
+// maxDownloadSize is the maximum size of a downloaded archive (100MB by
+// default). Paid editions such as GeoIP2-Enterprise may need a larger limit.
+var maxDownloadSize int64 = 100 * 1024 * 1024
 
 type CountryResponse struct {
-	IP      string `json:"ip"`
-	Country string `json:"country"`
+	IP          string `json:"ip"`
+	Network     string `json:"network,omitempty"`
+	Country     string `json:"country"`
+	CountryName string `json:"country_name,omitempty"`
 }
 
 type CityResponse struct {
-	IP      string `json:"ip"`
-	Country string `json:"country"`
-	City    string `json:"city,omitempty"`
-	Region  string `json:"region,omitempty"`
+	IP          string `json:"ip"`
+	Network     string `json:"network,omitempty"`
+	Country     string `json:"country"`
+	CountryName string `json:"country_name,omitempty"`
+	City        string `json:"city,omitempty"`
+	Region      string `json:"region,omitempty"`
+	RegionName  string `json:"region_name,omitempty"`
 }
 
 type RegionResponse struct {
-	IP      string `json:"ip"`
-	Country string `json:"country"`
-	Region  string `json:"region,omitempty"`
+	IP          string `json:"ip"`
+	Network     string `json:"network,omitempty"`
+	Country     string `json:"country"`
+	CountryName string `json:"country_name,omitempty"`
+	Region      string `json:"region,omitempty"`
+	RegionName  string `json:"region_name,omitempty"`
 }
 
-func logError(format string, v ...interface{}) {
-	if currentLogLevel >= LogLevelError {
-		log.Printf("[ERROR] "+format, v...)
-	}
+type ASNResponse struct {
+	IP           string `json:"ip"`
+	Network      string `json:"network,omitempty"`
+	Country      string `json:"country"`
+	ASN          uint   `json:"asn"`
+	Organization string `json:"organization,omitempty"`
 }
 
-func logInfo(format string, v ...interface{}) {
-	if currentLogLevel >= LogLevelInfo {
-		log.Printf("[INFO] "+format, v...)
-	}
+type NetworkResponse struct {
+	IP       string `json:"ip"`
+	Network  string `json:"network"`
+	Database string `json:"database,omitempty"`
 }
 
-func logDebug(format string, v ...interface{}) {
-	if currentLogLevel >= LogLevelDebug {
-		log.Printf("[DEBUG] "+format, v...)
+func main() {
+	// Configure log format and level
+	logLevelStr := os.Getenv("LOG_LEVEL")
+	if err := configureLogging(os.Getenv("LOG_FORMAT"), logLevelStr); err != nil {
+		logger.Warn("invalid logging configuration", "error", err)
 	}
-}
+	accessLogEnabled = os.Getenv("ACCESS_LOG") != "false"
 
-// detectDatabaseTypeValue detects the database type and returns true for City, false for Country
-func detectDatabaseTypeValue(db *geoip2.Reader) (bool, error) {
-	testIP := net.ParseIP("8.8.8.8")
+	logger.Debug("log level set", "level", logLevelStr)
 
-	// Try City lookup first
-	cityRecord, err := db.City(testIP)
-	if err == nil && cityRecord != nil {
-		return true, nil
+	forceUpdate := os.Getenv("FORCE_DB_UPDATE") == "true"
+	updateIntervalHours := nonNegativeIntFromEnv("DB_UPDATE_INTERVAL_HOURS", 720) // Default to 30 days (30 * 24 hours)
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		networks, err := parseTrustedProxies(proxies)
+		if err != nil {
+			logFatal("invalid TRUSTED_PROXIES", "error", err)
+		}
+		trustedProxies = networks
+		logger.Info("trusting forwarding headers from proxies", "networks", len(networks))
 	}
-
-	// Try Country lookup
-	countryRecord, err := db.Country(testIP)
-	if err == nil && countryRecord != nil {
-		return false, nil
+	if fallback := parseLanguageList(os.Getenv("GEOIP_LANGUAGE_FALLBACK")); len(fallback) > 0 {
+		languageFallback = fallback
 	}
-
-	return false, fmt.Errorf("unable to detect database type: both City and Country lookups failed")
-}
-
-func detectDatabaseType(db *geoip2.Reader) error {
-	isCity, err := detectDatabaseTypeValue(db)
-	if err != nil {
-		return err
+	if delimiter, ok := os.LookupEnv("FIELDS_DELIMITER"); ok && delimiter != "" {
+		fieldsDelimiter = delimiter
 	}
-
-	isCityDB.Store(isCity)
-	if isCity {
-		logInfo("Detected GeoIP database type: City (supports country, city, region)")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if maxAge := nonNegativeIntFromEnv("HEALTH_MAX_DB_AGE_HOURS", 0); maxAge > 0 {
+		healthMaxDatabaseAge = time.Duration(maxAge) * time.Hour
+	}
+	healthMaxFailedUpdate = nonNegativeIntFromEnv("HEALTH_MAX_FAILED_UPDATES", 0)
+	if canaries, err := parseHealthCanaries(os.Getenv("HEALTH_CANARIES")); err != nil {
+		logFatal("invalid HEALTH_CANARIES", "error", err)
 	} else {
-		logInfo("Detected GeoIP database type: Country (supports country only)")
+		healthCanaries = canaries
 	}
-	return nil
-}
-
-func main() {
-	// Configure log level
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	switch strings.ToUpper(logLevelStr) {
-	case "ERROR":
-		currentLogLevel = LogLevelError
-	case "DEBUG":
-		currentLogLevel = LogLevelDebug
-	case "INFO", "":
-		currentLogLevel = LogLevelInfo
-	default:
-		currentLogLevel = LogLevelInfo
-		logInfo("Unknown LOG_LEVEL '%s', defaulting to INFO", logLevelStr)
-	}
-
-	logDebug("Log level set to: %s", logLevelStr)
-
-	licenseKey := os.Getenv("MAXMIND_LICENSE_KEY")
-	dbPath := os.Getenv("GEOIP_DB_PATH") // Highest precedence
-	if dbPath == "" {
-		dbDir := os.Getenv("GEOIP_DB_DIR")
-		if dbDir != "" {
-			dbFileName := os.Getenv("GEOIP_DB_FILENAME")
-			if dbFileName == "" {
-				dbFileName = "GeoLite2-Country.mmdb" // Default filename if only directory is specified
-			}
-			dbPath = filepath.Join(dbDir, dbFileName)
-		} else {
-			dbPath = "/data/GeoLite2-Country.mmdb" // Global default if neither path nor dir is specified
+	if canaryFile := os.Getenv("DB_CANARY_FILE"); canaryFile != "" {
+		canaries, err := loadCanaryFile(canaryFile)
+		if err != nil {
+			logFatal("invalid DB_CANARY_FILE", "path", canaryFile, "error", err)
 		}
+		downloadCanaries = canaries
+		logger.Info("loaded download canaries", "canaries", len(canaries), "path", canaryFile)
 	}
-	forceUpdate := os.Getenv("FORCE_DB_UPDATE") == "true"
-	updateIntervalHoursStr := os.Getenv("DB_UPDATE_INTERVAL_HOURS")
-	updateIntervalHours := 720 // Default to 30 days (30 * 24 hours)
-	if updateIntervalHoursStr != "" {
-		if i, err := strconv.Atoi(updateIntervalHoursStr); err == nil && i >= 0 {
-			updateIntervalHours = i
-		} else if err != nil {
-			logInfo("Invalid DB_UPDATE_INTERVAL_HOURS '%s', using default %d", updateIntervalHoursStr, updateIntervalHours)
+	if percentStr := os.Getenv("DB_CANARY_MAX_CHANGED_PERCENT"); percentStr != "" {
+		if percent, err := strconv.ParseFloat(percentStr, 64); err == nil && percent >= 0 && percent <= 100 {
+			canaryMaxChangedPercent = percent
 		} else {
-			logInfo("DB_UPDATE_INTERVAL_HOURS must be non-negative, using default %d", updateIntervalHours)
+			logger.Warn("invalid setting, using default", "name", "DB_CANARY_MAX_CHANGED_PERCENT", "value", percentStr, "default", canaryMaxChangedPercent)
 		}
 	}
-
-	logDebug("Configuration - DB Path: %s, Update Interval: %d hours, Force Update: %v", dbPath, updateIntervalHours, forceUpdate)
-
-	// Check if database needs to be downloaded or updated
-	needsDownload := false
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		logInfo("GeoIP database not found at %s.", dbPath)
-		needsDownload = true
-	} else if forceUpdate {
-		logInfo("FORCE_DB_UPDATE is true, forcing database update.")
-		needsDownload = true
-	} else {
-		fileInfo, err := os.Stat(dbPath)
-		if err != nil {
-			logError("Failed to get file info for %s: %v", dbPath, err)
-			needsDownload = true
+	keepVersions = nonNegativeIntFromEnv("DB_KEEP_VERSIONS", 0)
+	verifyChecksums = os.Getenv("DB_VERIFY_CHECKSUM") != "false"
+	sharedVolume = os.Getenv("DB_SHARED_VOLUME") == "true"
+	if minutes := nonNegativeIntFromEnv("DB_UPDATE_LOCK_TIMEOUT_MINUTES", 0); minutes > 0 {
+		updateLockTimeout = time.Duration(minutes) * time.Minute
+	}
+	if minutes := nonNegativeIntFromEnv("DB_RETRY_INITIAL_DELAY_MINUTES", 0); minutes > 0 {
+		retryInitialDelay = time.Duration(minutes) * time.Minute
+	}
+	if minutes := nonNegativeIntFromEnv("DB_RETRY_MAX_DELAY_MINUTES", 0); minutes > 0 {
+		retryMaxDelay = time.Duration(minutes) * time.Minute
+	}
+	if maxMB := nonNegativeIntFromEnv("DB_MAX_DOWNLOAD_MB", 0); maxMB > 0 {
+		maxDownloadSize = int64(maxMB) * 1024 * 1024
+	}
+	diffReportsEnabled = os.Getenv("DB_DIFF_REPORT") != "false"
+	diffWatchValues = parseDiffWatchValues(os.Getenv("DB_DIFF_WATCH"))
+	if batchSizeStr := os.Getenv("LOOKUP_MAX_BATCH_SIZE"); batchSizeStr != "" {
+		if i, err := strconv.Atoi(batchSizeStr); err == nil && i > 0 {
+			maxBatchSize = i
 		} else {
-			lastModified := fileInfo.ModTime()
-			logDebug("Database file last modified: %s (age: %.1f hours)", lastModified.Format(time.RFC3339), time.Since(lastModified).Hours())
-			if time.Since(lastModified) > time.Duration(updateIntervalHours)*time.Hour {
-				logInfo("GeoIP database at %s is older than %d hours, initiating update.", dbPath, updateIntervalHours)
-				needsDownload = true
-			}
+			logger.Warn("invalid setting, using default", "name", "LOOKUP_MAX_BATCH_SIZE", "value", batchSizeStr, "default", maxBatchSize)
 		}
 	}
 
-	if needsDownload {
-		if licenseKey == "" {
-			log.Fatalf("MAXMIND_LICENSE_KEY not set. Cannot download or update GeoIP database. Please set the environment variable.")
+	databases, err := loadDatabaseConfig(updateIntervalHours)
+	if err != nil {
+		logFatal("invalid database configuration", "error", err)
+	}
+	source, err := newDownloadSource()
+	if err != nil {
+		logFatal("invalid download source", "error", err)
+	}
+	logger.Debug("download source configured", "source", source.String())
+
+	for _, entry := range databases {
+		logger.Debug("database configured", "database", entry.name, "path", entry.path, "edition", entry.editionID, "update_interval_hours", entry.updateInterval, "force_update", forceUpdate)
+
+		if entry.editionID != "" {
+			restoreState(entry)
 		}
-		logInfo("Starting GeoIP database download and verification.")
-		if err := downloadGeoLite2DB(licenseKey, dbPath); err != nil {
-			log.Fatalf("Failed to download or verify GeoIP database: %v", err)
+		ensureDatabase(source, entry, forceUpdate)
+		if err := reloadDatabase(entry); err != nil {
+			logFatal("failed to open database", "database", entry.name, "path", entry.path, "error", err)
 		}
-		logInfo("GeoIP database downloaded, verified, and updated successfully.")
-	} else {
-		logInfo("GeoIP database at %s is up to date.", dbPath)
+		registry.add(entry)
 	}
 
-	db, err := geoip2.Open(dbPath)
-	if err != nil {
-		log.Fatalf("Failed to open GeoIP database: %v", err)
+	// Start background goroutines for periodic database updates
+	for _, entry := range databases {
+		if entry.updateInterval > 0 && entry.editionID != "" && source.configured() == nil {
+			go periodicDatabaseUpdater(source, entry)
+		}
 	}
-	dbValue.Store(db)
 
-	// Detect database type (City or Country)
-	if err := detectDatabaseType(db); err != nil {
-		log.Fatalf("Failed to detect database type: %v", err)
+	// Reload databases replaced by an external updater
+	go handleReloadSignals()
+	watchStr := os.Getenv("DB_WATCH_INTERVAL_SECONDS")
+	if watchStr == "" && sharedVolume {
+		watchStr = "60" // Pick up builds downloaded by other replicas
 	}
-
-	// Start background goroutine for periodic database updates
-	if updateIntervalHours > 0 {
-		go periodicDatabaseUpdater(licenseKey, dbPath, updateIntervalHours)
+	if watchStr != "" {
+		if seconds, err := strconv.Atoi(watchStr); err == nil && seconds >= 0 {
+			if seconds > 0 {
+				go watchDatabaseFiles(time.Duration(seconds) * time.Second)
+			}
+		} else {
+			logger.Warn("invalid setting, file watching disabled", "name", "DB_WATCH_INTERVAL_SECONDS", "value", watchStr)
+		}
 	}
 
 	port := os.Getenv("PORT")
@@ -231,12 +216,27 @@ func main() {
 	mux.HandleFunc("/country/", countryHandler)
 	mux.HandleFunc("/city/", cityHandler)
 	mux.HandleFunc("/region/", regionHandler)
+	mux.HandleFunc("/asn/", asnHandler)
+	mux.HandleFunc("/network/", networkHandler)
+	mux.HandleFunc("/lookup", batchLookupHandler)
+	mux.HandleFunc("/lookup/", recordHandler)
+	mux.HandleFunc("/me", meHandler)
 	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/info", infoHandler)
+	mux.HandleFunc("/diff", diffHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/admin/reload", requireAdmin(http.MethodPost, adminReloadHandler))
+	mux.HandleFunc("/admin/update", requireAdmin(http.MethodPost, adminUpdateHandler(source)))
+	mux.HandleFunc("/admin/rollback", requireAdmin(http.MethodPost, adminRollbackHandler))
+	mux.HandleFunc("/admin/versions", requireAdmin(http.MethodGet, adminVersionsHandler))
+	mux.HandleFunc("/admin/database", requireAdmin(http.MethodGet, adminDatabaseHandler))
 
 	// Configure HTTP server with timeouts
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
+		Handler:      accessLogHandler(instrumentHandler(mux)),
 		ReadTimeout:  serverReadTimeout,
 		WriteTimeout: serverWriteTimeout,
 		IdleTimeout:  serverIdleTimeout,
@@ -248,15 +248,15 @@ func main() {
 
 	// Start server in goroutine
 	go func() {
-		logInfo("GeoIP API listening on port %s", port)
+		logger.Info("GeoIP API listening", "port", port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+			logFatal("HTTP server error", "error", err)
 		}
 	}()
 
 	// Wait for shutdown signal
 	<-stop
-	logInfo("Shutdown signal received, initiating graceful shutdown...")
+	logger.Info("shutdown signal received, initiating graceful shutdown")
 
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
@@ -264,246 +264,436 @@ func main() {
 
 	// Shutdown HTTP server gracefully
 	if err := server.Shutdown(ctx); err != nil {
-		logError("HTTP server shutdown error: %v", err)
+		logger.Error("HTTP server shutdown error", "error", err)
 	} else {
-		logInfo("HTTP server stopped gracefully")
+		logger.Info("HTTP server stopped gracefully")
 	}
 
-	// Cleanup database
-	dbMutex.Lock()
-	if dbRaw := dbValue.Load(); dbRaw != nil {
-		if db, ok := dbRaw.(*geoip2.Reader); ok {
-			db.Close()
-			logInfo("GeoIP database closed")
-		}
+	// Cleanup databases
+	for _, entry := range registry.all() {
+		entry.close()
 	}
-	dbMutex.Unlock()
 
-	logInfo("Shutdown complete")
+	logger.Info("shutdown complete")
 }
 
-func periodicDatabaseUpdater(licenseKey, dbPath string, intervalHours int) {
-	ticker := time.NewTicker(time.Duration(intervalHours) * time.Hour)
-	defer ticker.Stop()
+// ensureDatabase downloads the database at dbPath on startup when it is missing,
+// was last checked more than the update interval ago according to its
+// persisted update state, or when a forced update is requested.
+func ensureDatabase(source downloadSource, entry *databaseEntry, forceUpdate bool) {
+	dbPath, updateIntervalHours := entry.path, entry.updateInterval
+	if entry.editionID == "" {
+		if _, err := os.Stat(dbPath); err != nil {
+			logFatal("database not found and no edition is configured to download it", "database", entry.name, "path", dbPath)
+		}
+		logger.Debug("no edition configured, using existing file", "database", entry.name, "path", dbPath)
+		return
+	}
 
-	logInfo("Started periodic database updater (interval: %d hours)", intervalHours)
+	if err := source.configured(); err != nil {
+		if _, statErr := os.Stat(dbPath); statErr != nil {
+			logFatal("database not found and it cannot be downloaded", "database", entry.name, "path", dbPath, "error", err)
+		}
+		logger.Info("automatic updates disabled, using existing file", "database", entry.name, "path", dbPath, "reason", err)
+		return
+	}
 
-	for range ticker.C {
-		logDebug("Periodic check triggered - checking if database needs to be updated...")
+	var lock *updateLock
+	if sharedVolume {
+		// Replicas starting together wait for the one downloading, then see its result
+		var err error
+		if lock, err = waitForUpdateLock(entry); err != nil {
+			logger.Error("failed to lock database for updates, updating without coordination", "database", entry.name, "path", dbPath, "error", err)
+		} else {
+			defer lock.release()
+		}
+		restoreState(entry)
+	}
 
-		fileInfo, err := os.Stat(dbPath)
+	needsDownload, force := false, false
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		logger.Info("database not found", "database", entry.name, "path", dbPath)
+		needsDownload, force = true, true
+	} else if forceUpdate {
+		logger.Info("FORCE_DB_UPDATE is true, forcing database update", "database", entry.name)
+		needsDownload, force = true, true
+	} else if due := entry.updateDue(); updateIntervalHours > 0 && !due.After(time.Now()) {
+		logger.Info("database not checked within the update interval, checking for updates", "database", entry.name, "path", dbPath, "update_interval_hours", updateIntervalHours)
+		needsDownload = true
+	} else {
+		logger.Debug("database checked recently", "database", entry.name, "path", dbPath, "last_check", entry.LastCheck().Format(time.RFC3339), "next_check", due.Format(time.RFC3339))
+	}
+
+	if needsDownload {
+		logger.Info("starting database download and verification", "database", entry.name, "edition", entry.editionID, "source", source.String())
+		diff, err := downloadGeoLite2DB(source, entry, force)
+		entry.recordDownload(err)
+		if errors.Is(err, errDatabaseNotModified) {
+			logger.Info("database up to date", "database", entry.name, "edition", entry.editionID)
+			return
+		}
+		entry.recordDiff(diff)
 		if err != nil {
-			logError("Failed to get file info for %s: %v", dbPath, err)
-			continue
+			// An existing file keeps serving while the update is retried
+			if _, statErr := os.Stat(dbPath); statErr != nil {
+				if lock != nil {
+					lock.release() // logFatal skips deferred calls
+				}
+				logFatal("failed to download or verify database", "database", entry.name, "edition", entry.editionID, "error", err)
+			}
+			logger.Error("database download failed, using the existing file", "database", entry.name, "edition", entry.editionID,
+				"consecutive_failures", entry.Status().ConsecutiveFailures, "next_attempt", entry.updateDue().Format(time.RFC3339), "error", err)
+			return
 		}
+		logger.Info("database downloaded", "database", entry.name, "edition", entry.editionID)
+	} else {
+		logger.Info("database up to date", "database", entry.name, "path", dbPath)
+	}
+}
 
-		lastModified := fileInfo.ModTime()
-		ageHours := time.Since(lastModified).Hours()
-		logDebug("Database age: %.1f hours (threshold: %d hours)", ageHours, intervalHours)
+// updateDatabase downloads a fresh copy of the entry's edition and reloads it.
+// Unless force is set, nothing is downloaded when upstream has no newer build.
+// Concurrent updates of the same database are serialized.
+func updateDatabase(source downloadSource, entry *databaseEntry, force bool) error {
+	entry.updateMu.Lock()
+	defer entry.updateMu.Unlock()
 
-		if time.Since(lastModified) > time.Duration(intervalHours)*time.Hour {
-			logInfo("Database is older than %d hours, starting update...", intervalHours)
+	if entry.editionID == "" {
+		return fmt.Errorf("database %s has no edition configured", entry.name)
+	}
+	// Not a failed download: nothing can be retried until the configuration changes
+	if err := source.configured(); err != nil {
+		return err
+	}
 
-			if licenseKey == "" {
-				logError("MAXMIND_LICENSE_KEY not set, skipping database update")
-				continue
-			}
+	if sharedVolume {
+		lock, ok, err := acquireUpdateLock(entry.path)
+		switch {
+		case err != nil:
+			// As on startup, so the attempt is recorded and the next one scheduled
+			logger.Error("failed to lock database for updates, updating without coordination", "database", entry.name, "path", entry.path, "error", err)
+		case !ok:
+			return errUpdateLocked
+		default:
+			defer lock.release()
+
+			// Start from what other replicas checked and downloaded
+			restoreState(entry)
+			reloadIfReplaced(entry)
+		}
+	}
 
-			if err := downloadGeoLite2DB(licenseKey, dbPath); err != nil {
-				logError("Failed to update database: %v", err)
-				continue
-			}
+	start := time.Now()
+	diff, err := downloadGeoLite2DB(source, entry, force)
+	entry.recordDownload(err)
+	if errors.Is(err, errDatabaseNotModified) {
+		logger.Info("database up to date", "database", entry.name, "edition", entry.editionID, "duration", time.Since(start))
+		return nil
+	}
+	if err != nil {
+		logger.Error("database download failed", "database", entry.name, "edition", entry.editionID, "duration", time.Since(start),
+			"consecutive_failures", entry.Status().ConsecutiveFailures, "next_attempt", entry.updateDue().Format(time.RFC3339), "error", err)
+		return err
+	}
+	logger.Info("database downloaded", "database", entry.name, "edition", entry.editionID, "duration", time.Since(start))
 
-			logInfo("Database downloaded successfully, reloading...")
-			if err := reloadDatabase(dbPath); err != nil {
-				logError("Failed to reload database: %v", err)
-				continue
-			}
+	if err := reloadDatabase(entry); err != nil {
+		logger.Error("database reload failed", "database", entry.name, "path", entry.path, "error", err)
+		return err
+	}
+	entry.recordDiff(diff)
+	return nil
+}
 
-			logInfo("Database updated and reloaded successfully")
-		} else {
-			logDebug("Database is up to date (last modified: %s)", lastModified.Format(time.RFC3339))
+// periodicDatabaseUpdater checks upstream for a newer build one update
+// interval after the latest check, as recorded in the persisted update state.
+// The decision is based on the remote build date, so unchanged databases are
+// not downloaded again.
+func periodicDatabaseUpdater(source downloadSource, entry *databaseEntry) {
+	logger.Info("started periodic database updater", "database", entry.name, "edition", entry.editionID, "update_interval_hours", entry.updateInterval)
+
+	for {
+		due := entry.updateDue()
+		entry.recordNextCheck(due)
+		time.Sleep(time.Until(due))
+
+		if sharedVolume {
+			// Another replica may have checked in the meantime
+			entry.updateMu.Lock()
+			restoreState(entry)
+			reloadIfReplaced(entry)
+			entry.updateMu.Unlock()
+		}
+		// Skip the check if another update, e.g. through the admin API, moved it
+		if entry.updateDue().After(time.Now()) {
+			continue
+		}
+		logger.Debug("periodic check triggered", "database", entry.name)
+		err := updateDatabase(source, entry, false)
+		switch {
+		case errors.Is(err, errUpdateLocked):
+			logger.Debug("another replica is updating the database", "database", entry.name, "retry_in", lockRetryInterval)
+			time.Sleep(lockRetryInterval)
+		case err != nil && !entry.updateDue().After(time.Now()):
+			// The failure was not recorded, so the check would be due again right away
+			logger.Error("database update failed before it was attempted", "database", entry.name, "retry_in", lockRetryInterval, "error", err)
+			time.Sleep(lockRetryInterval)
 		}
 	}
 }
 
-func reloadDatabase(dbPath string) error {
-	newDB, err := geoip2.Open(dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open new database: %w", err)
+// editionForPath guesses which edition to download based on the filename,
+// for primary databases without GEOIP_EDITION_ID or an existing file.
+func editionForPath(dbPath string) string {
+	name := strings.ToLower(filepath.Base(dbPath))
+	if strings.Contains(name, "city") {
+		return "GeoLite2-City"
 	}
+	if !strings.Contains(name, "country") {
+		logger.Warn("cannot tell the edition from the file name, assuming GeoLite2-Country; set GEOIP_EDITION_ID to choose another edition", "path", dbPath)
+	}
+	return "GeoLite2-Country"
+}
 
-	// Detect database type for the new database (without storing yet)
-	newIsCityDB, err := detectDatabaseTypeValue(newDB)
+// downloadGeoLite2DB downloads and verifies the entry's edition from source
+// and moves it to the entry's path. Unless force is set, it first checks
+// whether the source has a newer build and returns errDatabaseNotModified if
+// not, or if the new build is the one replaced by the latest rollback. When a
+// previous file is replaced, it returns a diff report of the changes.
+func downloadGeoLite2DB(source downloadSource, entry *databaseEntry, force bool) (*databaseDiff, error) {
+	editionID, dbPath := entry.editionID, entry.path
+	logger.Debug("starting database download", "source", source.String(), "edition", editionID)
+
+	tmpDir, err := os.MkdirTemp("", "geoipdb")
 	if err != nil {
-		newDB.Close()
-		return fmt.Errorf("failed to detect new database type: %w", err)
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
 	}
+	defer os.RemoveAll(tmpDir)
 
-	// Acquire write lock to swap databases atomically
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	// Atomically swap both the database and its type flag together
-	oldDB := dbValue.Swap(newDB)
-	isCityDB.Store(newIsCityDB)
+	archivePath, newValidators, err := source.fetch(editionID, dbPath, tmpDir, entry.Validators(), force)
+	if err != nil {
+		return nil, err
+	}
 
-	if newIsCityDB {
-		logInfo("Reloaded GeoIP database type: City")
-	} else {
-		logInfo("Reloaded GeoIP database type: Country")
+	logger.Debug("download successful, extracting archive", "edition", editionID)
+	tempMMDBPath, err := extractDatabase(archivePath, tmpDir)
+	if err != nil {
+		return nil, err
 	}
 
-	// Close old database if it exists
-	if oldDB != nil {
-		if oldReader, ok := oldDB.(*geoip2.Reader); ok {
-			logInfo("Closing old GeoIP database.")
-			oldReader.Close()
-		}
+	// --- Verification Step 1: Load Test ---
+	logger.Debug("verifying downloaded database", "path", tempMMDBPath)
+	verifiedDB, err := openReader(tempMMDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("verification failed: new database is invalid: %w", err)
 	}
 
-	return nil
-}
+	// A build that was rolled back is only installed again when forced
+	if buildEpoch := verifiedDB.Metadata().BuildEpoch; !force && buildEpoch != 0 && buildEpoch == entry.rolledBackBuild() {
+		verifiedDB.Close()
+		entry.setValidators(newValidators)
+		return nil, fmt.Errorf("%w: build %d was rolled back", errDatabaseNotModified, buildEpoch)
+	}
 
-func downloadGeoLite2DB(licenseKey, dbPath string) error {
-	// Determine which edition to download based on filename
-	editionID := "GeoLite2-Country"
-	if strings.Contains(strings.ToLower(dbPath), "city") {
-		editionID = "GeoLite2-City"
+	// --- Verification Step 2: Canary Lookups ---
+	if err := verifyDownloadCanaries(verifiedDB); err != nil {
+		verifiedDB.Close()
+		return nil, err
 	}
 
-	logDebug("Starting database download from MaxMind (Edition: %s)", editionID)
+	// Close the verification database before moving the file to prevent resource leaks
+	kind := detectDatabaseKind(verifiedDB)
+	verifiedDB.Close()
 
-	// Build URL with proper encoding
-	downloadURL := fmt.Sprintf(
-		"https://download.maxmind.com/app/geoip_download?edition_id=%s&license_key=%s&suffix=tar.gz",
-		url.QueryEscape(editionID),
-		url.QueryEscape(licenseKey),
-	)
+	// --- Diff Report against the database being replaced ---
+	var diff *databaseDiff
+	if _, err := os.Stat(dbPath); err == nil && diffReportsEnabled && (kind == kindCity || kind == kindCountry || kind == kindASN) {
+		logger.Debug("computing database diff", "path", dbPath)
+		if diff, err = diffDatabaseFiles(dbPath, tempMMDBPath); err != nil {
+			logger.Error("failed to compute database diff", "path", dbPath, "error", err)
+		}
+	}
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: httpTimeout,
+	// Ensure the destination directory exists
+	dbDir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory %s: %w", dbDir, err)
 	}
 
-	resp, err := client.Get(downloadURL)
-	if err != nil {
-		return fmt.Errorf("failed to download database: %w", err)
+	// Keep the current file as a previous version for rollbacks
+	if err := archiveDatabase(dbPath); err != nil {
+		logger.Error("failed to keep previous database version", "path", dbPath, "error", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download database: received status code %d, response: %s", resp.StatusCode, resp.Status)
+	// Atomically replace the database file
+	logger.Debug("moving verified database into place", "from", tempMMDBPath, "path", dbPath)
+	if err := os.Rename(tempMMDBPath, dbPath); err != nil {
+		return nil, fmt.Errorf("failed to move verified database file from %s to %s: %w", tempMMDBPath, dbPath, err)
 	}
 
-	logDebug("Download successful, extracting archive...")
-	tmpDir, err := os.MkdirTemp("", "geoipdb")
+	entry.setValidators(newValidators)
+	logger.Debug("database file updated", "path", dbPath)
+	return diff, nil
+}
+
+// extractDatabase extracts the first .mmdb file from a .tar.gz archive into
+// dir and returns its path. Sources may also serve a plain .mmdb file, which
+// is used as is, or a gzipped one (.mmdb.gz, as DB-IP publishes them).
+func extractDatabase(archivePath, dir string) (string, error) {
+	archive, err := os.Open(archivePath)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary directory: %w", err)
+		return "", fmt.Errorf("failed to open downloaded archive: %w", err)
+	}
+	defer archive.Close()
+
+	// Tell gzip archives from plain databases by the gzip magic number
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(archive, magic); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		logger.Debug("downloaded file is not a gzip archive, using it as a plain .mmdb file")
+		mmdbPath := filepath.Join(dir, "download.mmdb")
+		if err := os.Rename(archivePath, mmdbPath); err != nil {
+			return "", fmt.Errorf("failed to move downloaded database: %w", err)
+		}
+		return mmdbPath, nil
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to read downloaded archive: %w", err)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	// Limit the download size to prevent disk exhaustion
-	limitedReader := io.LimitReader(resp.Body, maxDownloadSize)
-	gzr, err := gzip.NewReader(limitedReader)
+	gzr, err := gzip.NewReader(archive)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return "", fmt.Errorf("failed to create gzip reader: %w", err)
 	}
 	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
-	var mmdbFileName string
-	var tempMMDBPath string
+	// Tar archives carry the "ustar" magic at offset 257 of their first header
+	contents := bufio.NewReader(gzr)
+	if header, err := contents.Peek(262); err != nil || string(header[257:]) != "ustar" {
+		logger.Debug("downloaded file is not a tar archive, extracting it as a gzipped .mmdb file")
+		return writeDatabase(filepath.Join(dir, "download.mmdb"), contents)
+	}
 
+	tr := tar.NewReader(contents)
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("failed to read tar header: %w", err)
+			return "", fmt.Errorf("failed to read tar header: %w", err)
 		}
 
 		if strings.HasSuffix(header.Name, ".mmdb") {
-			mmdbFileName = filepath.Base(header.Name)
-			tempMMDBPath = filepath.Join(tmpDir, mmdbFileName)
-			outFile, err := os.Create(tempMMDBPath)
-			if err != nil {
-				return fmt.Errorf("failed to create temporary .mmdb file: %w", err)
-			}
-
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to write to temporary .mmdb file: %w", err)
-			}
-			outFile.Close()
-			break // Found the .mmdb file, no need to read further
+			// Found the .mmdb file, no need to read further
+			return writeDatabase(filepath.Join(dir, filepath.Base(header.Name)), tr)
 		}
 	}
+	return "", fmt.Errorf("could not find .mmdb file in archive")
+}
 
-	if tempMMDBPath == "" {
-		return fmt.Errorf("could not find .mmdb file in archive")
-	}
-
-	// --- Verification Step 1: Load Test ---
-	logDebug("Verifying downloaded database: %s", tempMMDBPath)
-	verifiedDB, err := geoip2.Open(tempMMDBPath)
+// writeDatabase writes an extracted database to path, refusing to
+// decompress more than maxExtractedSize bytes.
+func writeDatabase(path string, r io.Reader) (string, error) {
+	outFile, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("verification failed: new database is invalid: %w", err)
+		return "", fmt.Errorf("failed to create temporary .mmdb file: %w", err)
 	}
+	defer outFile.Close()
 
-	// --- Verification Step 2: Lookup Test ---
-	testIP := net.ParseIP("8.8.8.8") // Google Public DNS, usually in US
-	record, err := verifiedDB.Country(testIP)
+	written, err := io.Copy(outFile, io.LimitReader(r, maxExtractedSize+1))
 	if err != nil {
-		verifiedDB.Close()
-		return fmt.Errorf("verification failed: lookup for %s failed on new database: %w", testIP, err)
+		return "", fmt.Errorf("failed to write to temporary .mmdb file: %w", err)
 	}
-	if record.Country.IsoCode != "US" {
-		logInfo("Warning: Test IP %s returned country %s, expected US. Continuing with update but this might indicate an issue.", testIP, record.Country.IsoCode)
-	} else {
-		logDebug("Verification successful: Test IP %s correctly identified as %s.", testIP, record.Country.IsoCode)
+	if written > maxExtractedSize {
+		return "", fmt.Errorf("extracted database exceeds the maximum of %d bytes", maxExtractedSize)
+	}
+	if err := outFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to write to temporary .mmdb file: %w", err)
 	}
+	return path, nil
+}
 
-	// Close the verification database before moving the file to prevent resource leaks
-	verifiedDB.Close()
+// fetchChecksum downloads a .sha256 file as published by MaxMind
+// ("<hex digest>  <file name>") and returns the lowercase hex digest.
+func fetchChecksum(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", redactURLError(err)
+	}
+	defer resp.Body.Close()
 
-	// Ensure the destination directory exists
-	dbDir := filepath.Dir(dbPath)
-	if err := os.MkdirAll(dbDir, 0755); err != nil {
-		return fmt.Errorf("failed to create database directory %s: %w", dbDir, err)
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPStatusError(resp)
 	}
 
-	// Atomically replace the database file
-	logDebug("Moving verified database from %s to %s", tempMMDBPath, dbPath)
-	if err := os.Rename(tempMMDBPath, dbPath); err != nil {
-		return fmt.Errorf("failed to move verified database file from %s to %s: %w", tempMMDBPath, dbPath, err)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
 	}
+	return parseChecksum(body)
+}
 
-	logDebug("Database file successfully updated at %s", dbPath)
-	return nil
+// parseChecksum returns the lowercase hex digest of a .sha256 file.
+func parseChecksum(body []byte) (string, error) {
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	sum := strings.ToLower(fields[0])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid SHA256 checksum %q", fields[0])
+	}
+	return sum, nil
 }
 
-// getDatabase safely retrieves the database reader with proper locking.
-// Returns the reader, a boolean indicating if it's a City database, and any error.
-// The caller must call the returned unlock function when done.
-func getDatabase() (*geoip2.Reader, bool, func(), error) {
-	dbMutex.RLock()
+// downloadArchive saves the response body of req to path and returns its
+// SHA256 hex digest and cache validators. Downloads larger than
+// maxDownloadSize, or shorter than the announced Content-Length, fail instead
+// of being silently cut. A 304 response returns errDatabaseNotModified.
+func downloadArchive(client *http.Client, req *http.Request, path string) (string, downloadValidators, error) {
+	var validators downloadValidators
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", validators, fmt.Errorf("failed to download database: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return "", validators, errDatabaseNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", validators, fmt.Errorf("failed to download database: %w", newHTTPStatusError(resp))
+	}
+	if resp.ContentLength > maxDownloadSize {
+		return "", validators, fmt.Errorf("failed to download database: size %d exceeds the maximum of %d bytes", resp.ContentLength, maxDownloadSize)
+	}
 
-	dbRaw := dbValue.Load()
-	if dbRaw == nil {
-		dbMutex.RUnlock()
-		return nil, false, nil, fmt.Errorf("database not available")
+	file, err := os.Create(path)
+	if err != nil {
+		return "", validators, fmt.Errorf("failed to create temporary archive file: %w", err)
 	}
+	defer file.Close()
 
-	db, ok := dbRaw.(*geoip2.Reader)
-	if !ok {
-		dbMutex.RUnlock()
-		return nil, false, nil, fmt.Errorf("database not available")
+	// Read one byte past the limit to tell a complete download from a cut one
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return "", validators, fmt.Errorf("failed to download database after %d bytes: %w", written, err)
+	}
+	if written > maxDownloadSize {
+		return "", validators, fmt.Errorf("failed to download database: size exceeds the maximum of %d bytes", maxDownloadSize)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return "", validators, fmt.Errorf("failed to download database: truncated after %d of %d bytes", written, resp.ContentLength)
+	}
+	if err := file.Close(); err != nil {
+		return "", validators, fmt.Errorf("failed to write temporary archive file: %w", err)
 	}
 
-	isCity := isCityDB.Load()
-	return db, isCity, dbMutex.RUnlock, nil
+	logger.Debug("downloaded file", "bytes", written, "path", path)
+	validators.ETag = resp.Header.Get("ETag")
+	validators.LastModified = resp.Header.Get("Last-Modified")
+	return hex.EncodeToString(hash.Sum(nil)), validators, nil
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -514,208 +704,249 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain")
 
-	dbType := "Country"
-	if isCityDB.Load() {
-		dbType = "City"
+	var databases strings.Builder
+	for _, entry := range registry.all() {
+		fmt.Fprintf(&databases, "  %-26s - %s\n", entry.name, entry.Kind())
 	}
 
 	fmt.Fprintf(w, `GeoIP API
-Database Type: %s
-
+Databases:
+%s
 Endpoints:
+  /me                        - Returns the full record (JSON) for the caller's own IP
   /country/{ip}              - Returns country code only
   /city/{ip}                 - Returns country + city + region
   /region/{ip}               - Returns country + region
-  /health                    - Health check
+  /asn/{ip}                  - Returns country + ASN + AS organization
+  /network/{ip}              - Returns the matched network prefix (?database= for one database)
+  /lookup/{ip}               - Returns the full record (JSON) from all loaded databases
+  POST /lookup               - Batch lookup (JSON array or newline-delimited IPs)
+  /health                    - Health check (plain text readiness)
+  /livez                     - Liveness check
+  /readyz                    - Readiness report (JSON)
+  /info                      - Database metadata and update status (JSON)
+  /diff                      - Changes made by the latest database update (JSON)
+  /metrics                   - Prometheus metrics
+  POST /admin/reload         - Reload databases from disk (requires ADMIN_TOKEN)
+  POST /admin/update         - Download and reload databases now (requires ADMIN_TOKEN)
+  POST /admin/rollback       - Restore a previous database version (requires ADMIN_TOKEN)
+  /admin/versions            - List kept database versions (requires ADMIN_TOKEN)
+  /admin/database            - Download the loaded database file (requires ADMIN_TOKEN)
+
+Omit {ip} (e.g. /country/) to look up the caller's own address.
 
 Response Formats:
   Add ?format=json for JSON response (default: plain text)
+  Add ?lang=de (or send Accept-Language) for localized names
+  Add ?fields=country,city,location.latitude to select fields (text: ?delimiter=|)
 
 Examples:
   /country/8.8.8.8           -> US
-  /country/8.8.8.8?format=json -> {"ip":"8.8.8.8","country":"US"}
+  /country/8.8.8.8?format=json -> {"ip":"8.8.8.8","network":"8.8.8.0/24","country":"US"}
 
   /city/8.8.8.8              -> US|Mountain View|CA
-  /city/8.8.8.8?format=json  -> {"ip":"8.8.8.8","country":"US","city":"Mountain View","region":"CA"}
+  /city/8.8.8.8?format=json  -> {"ip":"8.8.8.8","network":"8.8.8.0/24","country":"US","city":"Mountain View","region":"CA"}
 
   /region/8.8.8.8            -> US|CA
-  /region/8.8.8.8?format=json -> {"ip":"8.8.8.8","country":"US","region":"CA"}
+  /region/8.8.8.8?format=json -> {"ip":"8.8.8.8","network":"8.8.8.0/24","country":"US","region":"CA"}
+
+  /asn/8.8.8.8               -> US|15169|GOOGLE
+  /asn/8.8.8.8?format=json   -> {"ip":"8.8.8.8","network":"8.8.8.0/24","country":"US","asn":15169,"organization":"GOOGLE"}
+
+  /network/8.8.8.8           -> 8.8.8.0/24
+
+  /lookup/8.8.8.8?fields=country,city,postal&format=text -> US|Mountain View|94035
+
+  POST /lookup ["8.8.8.8","bad"] -> [{"ip":"8.8.8.8","country":"US",...},{"ip":"bad","error":"invalid IP address"}]
 
 Note: City and region data only available with GeoLite2-City database.
-`, dbType)
+      ASN data only available when GEOIP_ASN_DB_PATH is configured.
+`, databases.String())
 }
 
-func countryHandler(w http.ResponseWriter, r *http.Request) {
-	ipStr := strings.TrimPrefix(r.URL.Path, "/country/")
+// parseIPFromPath extracts and validates the IP following prefix in the URL path.
+// When the path has no IP, the caller's own address is used.
+// It writes an error response and returns false when the IP is invalid.
+func parseIPFromPath(w http.ResponseWriter, r *http.Request, prefix string) (string, net.IP, bool) {
+	ipStr := strings.TrimPrefix(r.URL.Path, prefix)
 
 	if ipStr == "" {
-		http.Error(w, "Usage: /country/{ip} or /country/{ip}?format=json", http.StatusBadRequest)
-		return
+		ip, err := clientIP(r)
+		if err != nil {
+			logger.Debug("failed to determine client IP", "error", err)
+			http.Error(w, "Unable to determine client IP address", http.StatusBadRequest)
+			return "", nil, false
+		}
+		return ip.String(), ip, true
 	}
 
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		logDebug("Invalid IP address requested: %s", ipStr)
+		logger.Debug("invalid IP address requested", "ip", ipStr)
 		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	return ipStr, ip, true
+}
+
+func countryHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr, ip, ok := parseIPFromPath(w, r, "/country/")
+	if !ok {
 		return
 	}
 
-	db, isCity, unlock, err := getDatabase()
-	if err != nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	session, ok := openLookupSession(w, r)
+	if !ok {
 		return
 	}
-	defer unlock()
+	defer session.close()
 
-	var country string
-	if isCity {
-		record, err := db.City(ip)
-		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			logDebug("IP lookup: %s -> Country: %s", ipStr, country)
-		}
-	} else {
-		record, err := db.Country(ip)
-		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			logDebug("IP lookup: %s -> Country: %s", ipStr, country)
-		}
+	rec := session.record(ip)
+	rec.IP = ipStr
+	result := rec.summary()
+	setLogCountry(r, result.Country)
+	if respondSelectedFields(w, r, rec, false) {
+		return
 	}
 
-	respondCountry(w, r, ipStr, country)
+	respondCountry(w, r, ipStr, result)
 }
 
 func cityHandler(w http.ResponseWriter, r *http.Request) {
-	ipStr := strings.TrimPrefix(r.URL.Path, "/city/")
+	ipStr, ip, ok := parseIPFromPath(w, r, "/city/")
+	if !ok {
+		return
+	}
 
-	if ipStr == "" {
-		http.Error(w, "Usage: /city/{ip} or /city/{ip}?format=json", http.StatusBadRequest)
+	session, ok := openLookupSession(w, r)
+	if !ok {
 		return
 	}
+	defer session.close()
 
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		logDebug("Invalid IP address requested: %s", ipStr)
-		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+	rec := session.record(ip)
+	rec.IP = ipStr
+	result := rec.summary()
+	setLogCountry(r, result.Country)
+	if respondSelectedFields(w, r, rec, false) {
 		return
 	}
 
-	db, isCity, unlock, err := getDatabase()
-	if err != nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	respondCity(w, r, ipStr, result)
+}
+
+func regionHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr, ip, ok := parseIPFromPath(w, r, "/region/")
+	if !ok {
 		return
 	}
-	defer unlock()
 
-	var country, city, region string
-	if isCity {
-		record, err := db.City(ip)
-		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			city = record.City.Names["en"]
-			if len(record.Subdivisions) > 0 {
-				region = record.Subdivisions[0].IsoCode
-			}
-			logDebug("IP lookup: %s -> Country: %s, City: %s, Region: %s", ipStr, country, city, region)
-		}
-	} else {
-		record, err := db.Country(ip)
-		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			logDebug("IP lookup (Country DB): %s -> Country: %s (no city/region data)", ipStr, country)
-		}
+	session, ok := openLookupSession(w, r)
+	if !ok {
+		return
 	}
+	defer session.close()
 
-	respondCity(w, r, ipStr, country, city, region)
+	rec := session.record(ip)
+	rec.IP = ipStr
+	result := rec.summary()
+	setLogCountry(r, result.Country)
+	if respondSelectedFields(w, r, rec, false) {
+		return
+	}
+
+	respondRegion(w, r, ipStr, result)
 }
 
-func regionHandler(w http.ResponseWriter, r *http.Request) {
-	ipStr := strings.TrimPrefix(r.URL.Path, "/region/")
+func asnHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr, ip, ok := parseIPFromPath(w, r, "/asn/")
+	if !ok {
+		return
+	}
 
-	if ipStr == "" {
-		http.Error(w, "Usage: /region/{ip} or /region/{ip}?format=json", http.StatusBadRequest)
+	session := newLookupSession()
+	defer session.close()
+	if session.asn == nil {
+		http.Error(w, "ASN database not available", http.StatusServiceUnavailable)
 		return
 	}
 
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		logDebug("Invalid IP address requested: %s", ipStr)
-		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+	rec := session.record(ip)
+	rec.IP = ipStr
+	result := rec.summary()
+	setLogCountry(r, result.Country)
+	if respondSelectedFields(w, r, rec, false) {
 		return
 	}
 
-	db, isCity, unlock, err := getDatabase()
-	if err != nil {
-		http.Error(w, "Database not available", http.StatusServiceUnavailable)
+	respondASN(w, r, ipStr, result)
+}
+
+// networkHandler returns the network an IP belongs to: the most specific
+// prefix matched across the loaded databases, within which every lookup
+// result is the same, or the prefix matched in the database named with
+// ?database=.
+func networkHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr, ip, ok := parseIPFromPath(w, r, "/network/")
+	if !ok {
 		return
 	}
-	defer unlock()
 
-	var country, region string
-	if isCity {
-		record, err := db.City(ip)
+	name := r.URL.Query().Get("database")
+	var network *net.IPNet
+	if name != "" {
+		entry := registry.get(name)
+		if entry == nil {
+			http.Error(w, fmt.Sprintf("Unknown database %q", name), http.StatusNotFound)
+			return
+		}
+		_, unlock, err := entry.acquire()
 		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			if len(record.Subdivisions) > 0 {
-				region = record.Subdivisions[0].IsoCode
-			}
-			logDebug("IP lookup: %s -> Country: %s, Region: %s", ipStr, country, region)
+			http.Error(w, "Database not available", http.StatusServiceUnavailable)
+			return
 		}
-	} else {
-		record, err := db.Country(ip)
+		network, err = lookupNetwork(entry.networkReader(), ip)
+		unlock()
 		if err != nil {
-			logDebug("IP lookup failed for %s: %v", ipStr, err)
-			country = "XX"
-		} else {
-			country = record.Country.IsoCode
-			if country == "" {
-				country = "XX"
-			}
-			logDebug("IP lookup (Country DB): %s -> Country: %s (no region data)", ipStr, country)
+			logger.Debug("network lookup failed", "ip", ip.String(), "database", name, "error", err)
+			http.Error(w, fmt.Sprintf("Network lookup failed: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		session := newLookupSession()
+		network = session.network(ip)
+		session.close()
+		if network == nil {
+			http.Error(w, "Database not available", http.StatusServiceUnavailable)
+			return
 		}
 	}
 
-	respondRegion(w, r, ipStr, country, region)
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NetworkResponse{
+			IP:       ipStr,
+			Network:  network.String(),
+			Database: name,
+		})
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, network.String())
+	}
 }
 
-func respondCountry(w http.ResponseWriter, r *http.Request, ip, country string) {
+func respondCountry(w http.ResponseWriter, r *http.Request, ip string, result lookupResult) {
 	format := r.URL.Query().Get("format")
+	country := result.Country
 
 	if format == "json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(CountryResponse{
-			IP:      ip,
-			Country: country,
+			IP:          ip,
+			Network:     result.Network,
+			Country:     country,
+			CountryName: result.CountryName,
 		})
 	} else {
 		w.Header().Set("Content-Type", "text/plain")
@@ -723,16 +954,20 @@ func respondCountry(w http.ResponseWriter, r *http.Request, ip, country string)
 	}
 }
 
-func respondCity(w http.ResponseWriter, r *http.Request, ip, country, city, region string) {
+func respondCity(w http.ResponseWriter, r *http.Request, ip string, result lookupResult) {
 	format := r.URL.Query().Get("format")
+	country, city, region := result.Country, result.City, result.Region
 
 	if format == "json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(CityResponse{
-			IP:      ip,
-			Country: country,
-			City:    city,
-			Region:  region,
+			IP:          ip,
+			Network:     result.Network,
+			Country:     country,
+			CountryName: result.CountryName,
+			City:        city,
+			Region:      region,
+			RegionName:  result.RegionName,
 		})
 	} else {
 		w.Header().Set("Content-Type", "text/plain")
@@ -749,15 +984,19 @@ func respondCity(w http.ResponseWriter, r *http.Request, ip, country, city, regi
 	}
 }
 
-func respondRegion(w http.ResponseWriter, r *http.Request, ip, country, region string) {
+func respondRegion(w http.ResponseWriter, r *http.Request, ip string, result lookupResult) {
 	format := r.URL.Query().Get("format")
+	country, region := result.Country, result.Region
 
 	if format == "json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(RegionResponse{
-			IP:      ip,
-			Country: country,
-			Region:  region,
+			IP:          ip,
+			Network:     result.Network,
+			Country:     country,
+			CountryName: result.CountryName,
+			Region:      region,
+			RegionName:  result.RegionName,
 		})
 	} else {
 		w.Header().Set("Content-Type", "text/plain")
@@ -770,31 +1009,22 @@ func respondRegion(w http.ResponseWriter, r *http.Request, ip, country, region s
 	}
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if database is available
-	dbRaw := dbValue.Load()
-	if dbRaw == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprint(w, "ERROR: Database not loaded")
-		return
-	}
-
-	db, ok := dbRaw.(*geoip2.Reader)
-	if !ok {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprint(w, "ERROR: Database invalid")
-		return
-	}
+func respondASN(w http.ResponseWriter, r *http.Request, ip string, result lookupResult) {
+	format := r.URL.Query().Get("format")
+	country, asn, organization := result.Country, result.ASN, result.Organization
 
-	// Perform a quick lookup test
-	testIP := net.ParseIP("8.8.8.8")
-	_, err := db.Country(testIP)
-	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, "ERROR: Database lookup failed: %v", err)
-		return
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ASNResponse{
+			IP:           ip,
+			Network:      result.Network,
+			Country:      country,
+			ASN:          asn,
+			Organization: organization,
+		})
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		// Text format: Country|ASN|Organization
+		fmt.Fprintf(w, "%s|%d|%s\n", country, asn, organization)
 	}
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "OK")
 }
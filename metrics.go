@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestDurationBuckets are the latency histogram upper bounds in seconds.
+var requestDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type requestKey struct {
+	endpoint string
+	code     int
+}
+
+type requestStats struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 // cumulative counts per requestDurationBuckets entry
+}
+
+// serviceMetrics holds the process-wide counters exposed on /metrics.
+// Database state is read from the registry at scrape time.
+type serviceMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*requestStats
+
+	inFlight     atomic.Int64
+	lookupHits   atomic.Uint64
+	lookupMisses atomic.Uint64
+}
+
+var metrics = &serviceMetrics{requests: make(map[requestKey]*requestStats)}
+
+// observeRequest records one completed request.
+func (m *serviceMetrics) observeRequest(endpoint string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := requestKey{endpoint, code}
+	stats, ok := m.requests[key]
+	if !ok {
+		stats = &requestStats{buckets: make([]uint64, len(requestDurationBuckets))}
+		m.requests[key] = stats
+	}
+
+	seconds := duration.Seconds()
+	stats.count++
+	stats.sum += seconds
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// observeLookup records whether a lookup found a country or fell back to "XX".
+func (m *serviceMetrics) observeLookup(hit bool) {
+	if hit {
+		m.lookupHits.Add(1)
+	} else {
+		m.lookupMisses.Add(1)
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// extend the write deadline of long admin operations.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentHandler records request counts, latency and in-flight requests.
+// Requests are labelled by the matched mux pattern to keep cardinality bounded.
+func instrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+
+		metrics.inFlight.Add(1)
+		defer metrics.inFlight.Add(-1)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metrics.observeRequest(endpoint, recorder.status, time.Since(start))
+	})
+}
+
+// formatLabelValue escapes a Prometheus label value.
+func formatLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolGauge(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics renders all metrics in the Prometheus text exposition format.
+func (m *serviceMetrics) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	fmt.Fprintln(w, "# HELP geoip_http_requests_total Total HTTP requests by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE geoip_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "geoip_http_requests_total{endpoint=\"%s\",code=\"%d\"} %d\n", formatLabelValue(key.endpoint), key.code, m.requests[key].count)
+	}
+
+	fmt.Fprintln(w, "# HELP geoip_http_request_duration_seconds HTTP request latency by endpoint and status code.")
+	fmt.Fprintln(w, "# TYPE geoip_http_request_duration_seconds histogram")
+	for _, key := range keys {
+		stats := m.requests[key]
+		labels := fmt.Sprintf("endpoint=\"%s\",code=\"%d\"", formatLabelValue(key.endpoint), key.code)
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "geoip_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), stats.buckets[i])
+		}
+		fmt.Fprintf(w, "geoip_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, stats.count)
+		fmt.Fprintf(w, "geoip_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(stats.sum))
+		fmt.Fprintf(w, "geoip_http_request_duration_seconds_count{%s} %d\n", labels, stats.count)
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP geoip_http_requests_in_flight HTTP requests currently being served.")
+	fmt.Fprintln(w, "# TYPE geoip_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "geoip_http_requests_in_flight %d\n", m.inFlight.Load())
+
+	fmt.Fprintln(w, "# HELP geoip_lookups_total IP lookups by result (miss means the \"XX\" fallback was returned).")
+	fmt.Fprintln(w, "# TYPE geoip_lookups_total counter")
+	fmt.Fprintf(w, "geoip_lookups_total{result=\"hit\"} %d\n", m.lookupHits.Load())
+	fmt.Fprintf(w, "geoip_lookups_total{result=\"miss\"} %d\n", m.lookupMisses.Load())
+
+	entries := registry.all()
+	now := time.Now()
+
+	type loadedDatabase struct {
+		name, kind, dbType string
+		buildEpoch         uint
+	}
+	var loaded []loadedDatabase
+	for _, entry := range entries {
+		db, unlock, err := entry.acquire()
+		if err != nil {
+			continue
+		}
+		metadata := db.Metadata()
+		unlock()
+		loaded = append(loaded, loadedDatabase{
+			name:       formatLabelValue(entry.name),
+			kind:       formatLabelValue(string(entry.Kind())),
+			dbType:     formatLabelValue(metadata.DatabaseType),
+			buildEpoch: metadata.BuildEpoch,
+		})
+	}
+
+	fmt.Fprintln(w, "# HELP geoip_database_info Loaded database, with its detected kind and MMDB type.")
+	fmt.Fprintln(w, "# TYPE geoip_database_info gauge")
+	for _, db := range loaded {
+		fmt.Fprintf(w, "geoip_database_info{database=\"%s\",kind=\"%s\",type=\"%s\"} 1\n", db.name, db.kind, db.dbType)
+	}
+	fmt.Fprintln(w, "# HELP geoip_database_build_epoch_seconds Build time of the loaded database.")
+	fmt.Fprintln(w, "# TYPE geoip_database_build_epoch_seconds gauge")
+	for _, db := range loaded {
+		fmt.Fprintf(w, "geoip_database_build_epoch_seconds{database=\"%s\"} %d\n", db.name, db.buildEpoch)
+	}
+	fmt.Fprintln(w, "# HELP geoip_database_age_seconds Time since the loaded database was built.")
+	fmt.Fprintln(w, "# TYPE geoip_database_age_seconds gauge")
+	for _, db := range loaded {
+		fmt.Fprintf(w, "geoip_database_age_seconds{database=\"%s\"} %s\n", db.name, formatFloat(now.Sub(time.Unix(int64(db.buildEpoch), 0)).Seconds()))
+	}
+
+	type statusMetric struct {
+		name, help, kind string
+		value            func(updateStatus) string
+	}
+	unixSeconds := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	statusMetrics := []statusMetric{
+		{"geoip_database_loaded_timestamp_seconds", "Time the database was last loaded successfully.", "gauge",
+			func(s updateStatus) string { return unixSeconds(s.LoadedAt) }},
+		{"geoip_database_last_download_timestamp_seconds", "Time of the last download attempt (0 if none).", "gauge",
+			func(s updateStatus) string { return unixSeconds(s.LastDownloadAt) }},
+		{"geoip_database_last_download_success", "Whether the last download attempt succeeded (1) or failed (0).", "gauge",
+			func(s updateStatus) string {
+				return strconv.Itoa(boolGauge(!s.LastDownloadAt.IsZero() && s.LastDownloadError == ""))
+			}},
+		{"geoip_database_consecutive_download_failures", "Download failures since the last successful download.", "gauge",
+			func(s updateStatus) string { return strconv.Itoa(s.ConsecutiveFailures) }},
+		{"geoip_database_last_reload_timestamp_seconds", "Time of the last reload attempt (0 if none).", "gauge",
+			func(s updateStatus) string { return unixSeconds(s.LastReloadAt) }},
+		{"geoip_database_last_reload_success", "Whether the last reload attempt succeeded (1) or failed (0).", "gauge",
+			func(s updateStatus) string {
+				return strconv.Itoa(boolGauge(!s.LastReloadAt.IsZero() && s.LastReloadError == ""))
+			}},
+		{"geoip_database_reload_failures_total", "Failed reload attempts.", "counter",
+			func(s updateStatus) string { return strconv.Itoa(s.ReloadFailures) }},
+	}
+
+	statuses := make([]updateStatus, len(entries))
+	for i, entry := range entries {
+		statuses[i] = entry.Status()
+	}
+	for _, metric := range statusMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for i, entry := range entries {
+			fmt.Fprintf(w, "%s{database=\"%s\"} %s\n", metric.name, formatLabelValue(entry.name), metric.value(statuses[i]))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP geoip_database_downloads_total Download attempts by result.")
+	fmt.Fprintln(w, "# TYPE geoip_database_downloads_total counter")
+	for i, entry := range entries {
+		name := formatLabelValue(entry.name)
+		fmt.Fprintf(w, "geoip_database_downloads_total{database=\"%s\",result=\"success\"} %d\n", name, statuses[i].DownloadSuccesses)
+		fmt.Fprintf(w, "geoip_database_downloads_total{database=\"%s\",result=\"failure\"} %d\n", name, statuses[i].DownloadFailures)
+		fmt.Fprintf(w, "geoip_database_downloads_total{database=\"%s\",result=\"not_modified\"} %d\n", name, statuses[i].NotModified)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeMetrics(w)
+}
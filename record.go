@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoRecord is the full lookup result, combining every loaded database.
+// Field names follow the MaxMind GeoIP2 web service conventions.
+type geoRecord struct {
+	IP                 string              `json:"ip"`
+	Network            string              `json:"network,omitempty"` // most specific matched prefix, see lookupSession.network
+	Continent          *continentRecord    `json:"continent,omitempty"`
+	Country            *countryRecord      `json:"country,omitempty"`
+	RegisteredCountry  *countryRecord      `json:"registered_country,omitempty"`
+	RepresentedCountry *countryRecord      `json:"represented_country,omitempty"`
+	Subdivisions       []subdivisionRecord `json:"subdivisions,omitempty"`
+	City               *cityRecord         `json:"city,omitempty"`
+	Postal             *postalRecord       `json:"postal,omitempty"`
+	Location           *locationRecord     `json:"location,omitempty"`
+	Traits             traitsRecord        `json:"traits"`
+}
+
+type continentRecord struct {
+	Code      string `json:"code"`
+	GeoNameID uint   `json:"geoname_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type countryRecord struct {
+	ISOCode           string `json:"iso_code"`
+	GeoNameID         uint   `json:"geoname_id,omitempty"`
+	Name              string `json:"name,omitempty"`
+	IsInEuropeanUnion bool   `json:"is_in_european_union"`
+	Type              string `json:"type,omitempty"` // only set for represented countries
+}
+
+type subdivisionRecord struct {
+	ISOCode   string `json:"iso_code"`
+	GeoNameID uint   `json:"geoname_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type cityRecord struct {
+	GeoNameID uint   `json:"geoname_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type postalRecord struct {
+	Code string `json:"code"`
+}
+
+type locationRecord struct {
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	AccuracyRadius uint16  `json:"accuracy_radius,omitempty"`
+	MetroCode      uint    `json:"metro_code,omitempty"`
+	TimeZone       string  `json:"time_zone,omitempty"`
+}
+
+// traitsRecord carries the boolean traits from the City/Country databases
+// plus the data from the ASN, Anonymous-IP and Connection-Type databases.
+type traitsRecord struct {
+	IsInEuropeanUnion            bool   `json:"is_in_european_union"`
+	IsAnonymousProxy             bool   `json:"is_anonymous_proxy"`
+	IsSatelliteProvider          bool   `json:"is_satellite_provider"`
+	AutonomousSystemNumber       uint   `json:"autonomous_system_number,omitempty"`
+	AutonomousSystemOrganization string `json:"autonomous_system_organization,omitempty"`
+	ConnectionType               string `json:"connection_type,omitempty"`
+	IsAnonymous                  bool   `json:"is_anonymous,omitempty"`
+	IsAnonymousVPN               bool   `json:"is_anonymous_vpn,omitempty"`
+	IsHostingProvider            bool   `json:"is_hosting_provider,omitempty"`
+	IsPublicProxy                bool   `json:"is_public_proxy,omitempty"`
+	IsResidentialProxy           bool   `json:"is_residential_proxy,omitempty"`
+	IsTorExitNode                bool   `json:"is_tor_exit_node,omitempty"`
+}
+
+// countryAsCity widens a Country database record into the City layout,
+// which is a superset of it, so both can be converted the same way.
+func countryAsCity(record *geoip2.Country) *geoip2.City {
+	return &geoip2.City{
+		Continent:          record.Continent,
+		Country:            record.Country,
+		RegisteredCountry:  record.RegisteredCountry,
+		RepresentedCountry: record.RepresentedCountry,
+		Traits:             record.Traits,
+	}
+}
+
+// newGeoRecord converts a City (or widened Country) record into a geoRecord,
+// picking names in the first available of the given languages.
+func newGeoRecord(ip string, record *geoip2.City, languages []string) geoRecord {
+	rec := geoRecord{IP: ip}
+
+	if record.Continent.Code != "" {
+		rec.Continent = &continentRecord{
+			Code:      record.Continent.Code,
+			GeoNameID: record.Continent.GeoNameID,
+			Name:      localizedName(record.Continent.Names, languages),
+		}
+	}
+	if record.Country.IsoCode != "" {
+		rec.Country = &countryRecord{
+			ISOCode:           record.Country.IsoCode,
+			GeoNameID:         record.Country.GeoNameID,
+			Name:              localizedName(record.Country.Names, languages),
+			IsInEuropeanUnion: record.Country.IsInEuropeanUnion,
+		}
+	}
+	if record.RegisteredCountry.IsoCode != "" {
+		rec.RegisteredCountry = &countryRecord{
+			ISOCode:           record.RegisteredCountry.IsoCode,
+			GeoNameID:         record.RegisteredCountry.GeoNameID,
+			Name:              localizedName(record.RegisteredCountry.Names, languages),
+			IsInEuropeanUnion: record.RegisteredCountry.IsInEuropeanUnion,
+		}
+	}
+	if record.RepresentedCountry.IsoCode != "" {
+		rec.RepresentedCountry = &countryRecord{
+			ISOCode:           record.RepresentedCountry.IsoCode,
+			GeoNameID:         record.RepresentedCountry.GeoNameID,
+			Name:              localizedName(record.RepresentedCountry.Names, languages),
+			IsInEuropeanUnion: record.RepresentedCountry.IsInEuropeanUnion,
+			Type:              record.RepresentedCountry.Type,
+		}
+	}
+	for _, subdivision := range record.Subdivisions {
+		rec.Subdivisions = append(rec.Subdivisions, subdivisionRecord{
+			ISOCode:   subdivision.IsoCode,
+			GeoNameID: subdivision.GeoNameID,
+			Name:      localizedName(subdivision.Names, languages),
+		})
+	}
+	if record.City.GeoNameID != 0 || len(record.City.Names) > 0 {
+		rec.City = &cityRecord{
+			GeoNameID: record.City.GeoNameID,
+			Name:      localizedName(record.City.Names, languages),
+		}
+	}
+	if record.Postal.Code != "" {
+		rec.Postal = &postalRecord{Code: record.Postal.Code}
+	}
+	location := record.Location
+	if location.Latitude != 0 || location.Longitude != 0 || location.TimeZone != "" || location.AccuracyRadius != 0 {
+		rec.Location = &locationRecord{
+			Latitude:       location.Latitude,
+			Longitude:      location.Longitude,
+			AccuracyRadius: location.AccuracyRadius,
+			MetroCode:      location.MetroCode,
+			TimeZone:       location.TimeZone,
+		}
+	}
+
+	// The EU flag follows the country, falling back to the registered country
+	rec.Traits.IsInEuropeanUnion = record.Country.IsInEuropeanUnion || record.RegisteredCountry.IsInEuropeanUnion
+	rec.Traits.IsAnonymousProxy = record.Traits.IsAnonymousProxy
+	rec.Traits.IsSatelliteProvider = record.Traits.IsSatelliteProvider
+
+	return rec
+}
+
+// summary reduces a full record to the fields served by the classic endpoints.
+func (rec *geoRecord) summary() lookupResult {
+	result := lookupResult{
+		Network:      rec.Network,
+		Country:      "XX",
+		ASN:          rec.Traits.AutonomousSystemNumber,
+		Organization: rec.Traits.AutonomousSystemOrganization,
+	}
+	if rec.Country != nil {
+		result.Country = rec.Country.ISOCode
+		result.CountryName = rec.Country.Name
+	}
+	if rec.City != nil {
+		result.City = rec.City.Name
+	}
+	if len(rec.Subdivisions) > 0 {
+		result.Region = rec.Subdivisions[0].ISOCode
+		result.RegionName = rec.Subdivisions[0].Name
+	}
+	return result
+}
+
+// recordHandler returns every field known for an IP as JSON.
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr, ip, ok := parseIPFromPath(w, r, "/lookup/")
+	if !ok {
+		return
+	}
+	respondRecord(w, r, ipStr, ip)
+}
+
+// meHandler returns the full record for the caller's own address.
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	ip, err := clientIP(r)
+	if err != nil {
+		logger.Debug("failed to determine client IP", "error", err)
+		http.Error(w, "Unable to determine client IP address", http.StatusBadRequest)
+		return
+	}
+	respondRecord(w, r, ip.String(), ip)
+}
+
+// respondRecord writes the full record for ip, honouring ?fields=.
+func respondRecord(w http.ResponseWriter, r *http.Request, ipStr string, ip net.IP) {
+	session, ok := openLookupSession(w, r)
+	if !ok {
+		return
+	}
+	defer session.close()
+
+	rec := session.record(ip)
+	rec.IP = ipStr
+	if rec.Country != nil {
+		setLogCountry(r, rec.Country.ISOCode)
+	}
+	if respondSelectedFields(w, r, rec, true) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// retryInitialDelay is the delay before retrying a failed update for the
+	// first time. It doubles with every consecutive failure.
+	retryInitialDelay = time.Minute
+
+	// retryMaxDelay caps the delay between retries of a failed update.
+	retryMaxDelay = 6 * time.Hour
+)
+
+// httpStatusError is an unexpected HTTP response from a download source.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // from the Retry-After header, zero if absent
+}
+
+func (e *httpStatusError) Error() string {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Sprintf("received status code %d, response: %s (check the license key, account ID or source credentials)", e.StatusCode, e.Status)
+	case http.StatusTooManyRequests:
+		return fmt.Sprintf("received status code %d, response: %s (download limit reached)", e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("received status code %d, response: %s", e.StatusCode, e.Status)
+}
+
+// newHTTPStatusError describes an unexpected response.
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	return &httpStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// retryDelay returns how long to wait before retrying an update that failed
+// with err for the given number of consecutive times. It returns zero when
+// retrying early cannot help, and the next check should wait for the regular
+// update interval:
+//
+//   - 401 and 403 mean invalid credentials or an edition the account has no
+//     access to, and errSourceUnavailable missing configuration, none of
+//     which fix themselves.
+//   - 429 means the daily download limit is used up. The Retry-After header
+//     is honoured, otherwise the maximum delay is used.
+//   - Anything else, e.g. network errors, timeouts and 5xx responses, is
+//     retried with exponential backoff and jitter.
+func retryDelay(err error, failures int) time.Duration {
+	if errors.Is(err, errSourceUnavailable) {
+		return 0
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return 0
+		case http.StatusTooManyRequests:
+			if statusErr.RetryAfter > 0 {
+				return statusErr.RetryAfter
+			}
+			return retryMaxDelay
+		}
+	}
+
+	if failures < 1 {
+		failures = 1
+	}
+	delay := retryMaxDelay
+	if failures < 32 {
+		if backoff := retryInitialDelay << (failures - 1); backoff > 0 && backoff < retryMaxDelay {
+			delay = backoff
+		}
+	}
+	// Spread retries of many replicas over the second half of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	networkErr := errors.New("connection refused")
+	statusErr := func(code int, retryAfter time.Duration) error {
+		return fmt.Errorf("download failed: %w", &httpStatusError{StatusCode: code, Status: http.StatusText(code), RetryAfter: retryAfter})
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		min, max time.Duration
+	}{
+		{"first failure", networkErr, 1, 30 * time.Second, time.Minute},
+		{"no failures counted", networkErr, 0, 30 * time.Second, time.Minute},
+		{"third failure", networkErr, 3, 2 * time.Minute, 4 * time.Minute},
+		{"server error", statusErr(http.StatusBadGateway, 0), 2, time.Minute, 2 * time.Minute},
+		{"below the cap", networkErr, 9, 128 * time.Minute, 256 * time.Minute},
+		{"capped", networkErr, 10, 3 * time.Hour, 6 * time.Hour},
+		{"shift overflow", networkErr, 100, 3 * time.Hour, 6 * time.Hour},
+		{"unauthorized", statusErr(http.StatusUnauthorized, 0), 1, 0, 0},
+		{"forbidden", statusErr(http.StatusForbidden, 0), 5, 0, 0},
+		{"source not configured", fmt.Errorf("%w: MAXMIND_LICENSE_KEY not set", errSourceUnavailable), 1, 0, 0},
+		{"rate limited", statusErr(http.StatusTooManyRequests, 0), 1, 6 * time.Hour, 6 * time.Hour},
+		{"rate limited with retry-after", statusErr(http.StatusTooManyRequests, 90*time.Minute), 1, 90 * time.Minute, 90 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := retryDelay(tt.err, tt.failures); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(%v, %d) = %s, want between %s and %s", tt.err, tt.failures, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// downloadSource fetches database archives for an edition.
+type downloadSource interface {
+	fmt.Stringer
+
+	// fetch stores the archive of editionID (a .tar.gz, or a plain .mmdb) in
+	// dir and returns its path and cache validators. The archive is checked
+	// against its published checksum when verifyChecksums is set. Unless
+	// force is set, it returns errDatabaseNotModified when the source has no
+	// newer build than the file at dbPath.
+	fetch(editionID, dbPath, dir string, validators downloadValidators, force bool) (string, downloadValidators, error)
+
+	// configured returns an error wrapping errSourceUnavailable when the
+	// source lacks the configuration it needs to download, e.g. credentials.
+	configured() error
+}
+
+// errSourceUnavailable means the download source is not configured, so
+// updates are skipped instead of failing and being retried.
+var errSourceUnavailable = errors.New("download source not configured")
+
+// newDownloadSource configures the download source from the environment.
+// DB_SOURCE_URL selects an HTTP(S) mirror, an s3:// bucket or a local
+// file:// path; without it, databases are downloaded from MaxMind.
+func newDownloadSource() (downloadSource, error) {
+	sourceURL := os.Getenv("DB_SOURCE_URL")
+	if sourceURL == "" {
+		return newMaxMindSource(os.Getenv("MAXMIND_ACCOUNT_ID"), os.Getenv("MAXMIND_LICENSE_KEY")), nil
+	}
+
+	if strings.HasPrefix(sourceURL, "/") {
+		return &localSource{path: sourceURL}, nil
+	}
+	parsed, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_SOURCE_URL: %w", err)
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		return newMirrorSource(sourceURL), nil
+	case "s3":
+		return newS3Source(parsed.Host, strings.TrimPrefix(parsed.Path, "/"))
+	case "file":
+		return &localSource{path: parsed.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DB_SOURCE_URL scheme %q, expected http, https, s3 or file", parsed.Scheme)
+	}
+}
+
+// editionPath fills the {edition} placeholder of a URL or path template.
+// Templates without a placeholder are treated as a directory holding
+// <edition>.tar.gz files.
+func editionPath(template, editionID string) string {
+	if strings.Contains(template, "{edition}") {
+		return strings.ReplaceAll(template, "{edition}", editionID)
+	}
+	return strings.TrimSuffix(template, "/") + "/" + editionID + ".tar.gz"
+}
+
+// redactURLError removes the query string from the URL of a failed request.
+// Error texts end up in logs, the update state file and /info, and queries
+// can carry credentials such as the license key of the legacy MaxMind
+// endpoint or a presigned signature.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			u.RawQuery, u.User = "", nil
+			urlErr.URL = u.String()
+		}
+	}
+	return err
+}
+
+// httpSource downloads archives over HTTP(S). MaxMind, mirrors and
+// S3-compatible buckets differ only in their URLs and authentication.
+type httpSource struct {
+	name        string
+	client      *http.Client
+	archiveURL  func(editionID string) string
+	checksumURL func(editionID string) string
+	authorize   func(req *http.Request) // adds credentials, may be nil
+	unavailable error                   // set when the source is missing configuration
+}
+
+func (s *httpSource) String() string {
+	return s.name
+}
+
+func (s *httpSource) configured() error {
+	return s.unavailable
+}
+
+func (s *httpSource) newRequest(method, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.authorize != nil {
+		s.authorize(req)
+	}
+	return req, nil
+}
+
+func (s *httpSource) fetch(editionID, dbPath, dir string, validators downloadValidators, force bool) (string, downloadValidators, error) {
+	if s.unavailable != nil {
+		return "", downloadValidators{}, s.unavailable
+	}
+	archiveURL := s.archiveURL(editionID)
+
+	// Skip the download when upstream has nothing new, to spare the download quota
+	if !force {
+		if head, err := s.newRequest(http.MethodHead, archiveURL); err == nil && !remoteIsNewer(s.client, head, dbPath, validators) {
+			return "", downloadValidators{}, errDatabaseNotModified
+		}
+	}
+
+	// Fetch the published checksum first, so a mismatch aborts before extraction
+	var expectedSum string
+	if verifyChecksums {
+		req, err := s.newRequest(http.MethodGet, s.checksumURL(editionID))
+		if err != nil {
+			return "", downloadValidators{}, fmt.Errorf("failed to create checksum request: %w", err)
+		}
+		if expectedSum, err = fetchChecksum(s.client, req); err != nil {
+			return "", downloadValidators{}, fmt.Errorf("failed to download checksum: %w", err)
+		}
+	}
+
+	req, err := s.newRequest(http.MethodGet, archiveURL)
+	if err != nil {
+		return "", downloadValidators{}, fmt.Errorf("failed to create download request: %w", err)
+	}
+	if !force {
+		setConditionalHeaders(req, dbPath, validators)
+	}
+
+	archivePath := filepath.Join(dir, "archive")
+	actualSum, newValidators, err := downloadArchive(s.client, req, archivePath)
+	if err != nil {
+		return "", downloadValidators{}, err
+	}
+
+	// --- Verification Step 0: Archive Checksum ---
+	if verifyChecksums {
+		if actualSum != expectedSum {
+			return "", downloadValidators{}, fmt.Errorf("verification failed: archive SHA256 %s does not match published checksum %s", actualSum, expectedSum)
+		}
+		logger.Debug("archive checksum verified", "sha256", actualSum)
+	}
+	return archivePath, newValidators, nil
+}
+
+// newMaxMindSource downloads from MaxMind. With an account ID, it uses the
+// current download API with HTTP basic auth; otherwise it falls back to the
+// legacy endpoint that takes the license key as a query parameter.
+func newMaxMindSource(accountID, licenseKey string) *httpSource {
+	source := &httpSource{name: "MaxMind", client: &http.Client{Timeout: httpTimeout}}
+	if licenseKey == "" {
+		source.unavailable = fmt.Errorf("%w: MAXMIND_LICENSE_KEY not set", errSourceUnavailable)
+	}
+
+	if accountID != "" {
+		downloadURL := func(editionID, suffix string) string {
+			return fmt.Sprintf("https://download.maxmind.com/geoip/databases/%s/download?suffix=%s", url.PathEscape(editionID), suffix)
+		}
+		source.archiveURL = func(editionID string) string { return downloadURL(editionID, "tar.gz") }
+		source.checksumURL = func(editionID string) string { return downloadURL(editionID, "tar.gz.sha256") }
+		// The API redirects to a storage host; net/http drops the
+		// credentials when following a redirect to another host.
+		source.authorize = func(req *http.Request) { req.SetBasicAuth(accountID, licenseKey) }
+		return source
+	}
+
+	downloadURL := func(editionID, suffix string) string {
+		return fmt.Sprintf(
+			"https://download.maxmind.com/app/geoip_download?edition_id=%s&license_key=%s&suffix=%s",
+			url.QueryEscape(editionID),
+			url.QueryEscape(licenseKey),
+			suffix,
+		)
+	}
+	source.archiveURL = func(editionID string) string { return downloadURL(editionID, "tar.gz") }
+	source.checksumURL = func(editionID string) string { return downloadURL(editionID, "tar.gz.sha256") }
+	return source
+}
+
+// newMirrorSource downloads from an HTTP(S) mirror. The URL may contain an
+// {edition} placeholder, and credentials as user:password@host. Checksums are
+// read from the archive URL with a .sha256 suffix.
+func newMirrorSource(template string) *httpSource {
+	name := template
+	if parsed, err := url.Parse(template); err == nil {
+		name = strings.ReplaceAll(parsed.Redacted(), "%7Bedition%7D", "{edition}")
+	}
+	return &httpSource{
+		name:        "mirror " + name,
+		client:      &http.Client{Timeout: httpTimeout},
+		archiveURL:  func(editionID string) string { return editionPath(template, editionID) },
+		checksumURL: func(editionID string) string { return editionPath(template, editionID) + ".sha256" },
+	}
+}
+
+// newS3Source downloads from an S3-compatible bucket with path-style URLs.
+// Requests are signed with AWS Signature Version 4 when AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY are set, and anonymous otherwise.
+func newS3Source(bucket, keyTemplate string) (*httpSource, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("DB_SOURCE_URL must name a bucket, e.g. s3://bucket/geoip/{edition}.tar.gz")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+	}
+
+	objectURL := func(editionID string) string {
+		key := editionPath(keyTemplate, editionID)
+		segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		return endpoint + "/" + url.PathEscape(bucket) + "/" + strings.Join(segments, "/")
+	}
+
+	source := &httpSource{
+		name:        fmt.Sprintf("s3://%s/%s", bucket, keyTemplate),
+		client:      &http.Client{Timeout: httpTimeout},
+		archiveURL:  objectURL,
+		checksumURL: func(editionID string) string { return objectURL(editionID) + ".sha256" },
+	}
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+		source.authorize = func(req *http.Request) {
+			signS3Request(req, region, accessKey, secretKey, sessionToken, time.Now())
+		}
+	}
+	return source, nil
+}
+
+// signS3Request signs a bodiless request with AWS Signature Version 4. It
+// signs the host, any Range header and all x-amz-* headers.
+func signS3Request(req *http.Request, region, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a query component as Signature Version 4 expects.
+func s3Escape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// localSource copies databases from a local directory or file, e.g. a
+// volume where they are staged. The path may contain an {edition}
+// placeholder; a directory is searched for <edition>.mmdb, then
+// <edition>.tar.gz.
+type localSource struct {
+	path string
+}
+
+func (s *localSource) String() string {
+	return "local " + s.path
+}
+
+func (s *localSource) configured() error {
+	return nil
+}
+
+// resolve returns the file holding editionID.
+func (s *localSource) resolve(editionID string) (string, error) {
+	if strings.Contains(s.path, "{edition}") {
+		return strings.ReplaceAll(s.path, "{edition}", editionID), nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return s.path, nil
+	}
+	for _, name := range []string{editionID + ".mmdb", editionID + ".tar.gz"} {
+		candidate := filepath.Join(s.path, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("neither %s.mmdb nor %s.tar.gz found in %s", editionID, editionID, s.path)
+}
+
+func (s *localSource) fetch(editionID, dbPath, dir string, validators downloadValidators, force bool) (string, downloadValidators, error) {
+	src, err := s.resolve(editionID)
+	if err != nil {
+		return "", downloadValidators{}, fmt.Errorf("failed to find database: %w", err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return "", downloadValidators{}, fmt.Errorf("failed to find database: %w", err)
+	}
+	newValidators := downloadValidators{
+		ETag:         fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}
+
+	if !force && !localIsNewer(src, info, dbPath, validators, newValidators) {
+		return "", downloadValidators{}, errDatabaseNotModified
+	}
+
+	var expectedSum string
+	if verifyChecksums {
+		body, err := os.ReadFile(src + ".sha256")
+		if err == nil {
+			expectedSum, err = parseChecksum(body)
+		}
+		if err != nil {
+			return "", downloadValidators{}, fmt.Errorf("failed to read checksum: %w", err)
+		}
+	}
+
+	archivePath := filepath.Join(dir, "archive")
+	actualSum, err := copyWithChecksum(src, archivePath)
+	if err != nil {
+		return "", downloadValidators{}, fmt.Errorf("failed to copy database from %s: %w", src, err)
+	}
+	if verifyChecksums && actualSum != expectedSum {
+		return "", downloadValidators{}, fmt.Errorf("verification failed: archive SHA256 %s does not match published checksum %s", actualSum, expectedSum)
+	}
+	return archivePath, newValidators, nil
+}
+
+// localIsNewer reports whether the staged file src is newer than the file
+// at dbPath: by its validators, by build epoch for plain .mmdb files, and
+// otherwise by modification time.
+func localIsNewer(src string, info os.FileInfo, dbPath string, previous, current downloadValidators) bool {
+	if previous.ETag != "" && previous.ETag == current.ETag {
+		return false
+	}
+	local, err := os.Stat(dbPath)
+	if err != nil {
+		return true
+	}
+	if strings.HasSuffix(src, ".mmdb") {
+		srcEpoch, srcErr := databaseBuildEpoch(src)
+		localEpoch, localErr := databaseBuildEpoch(dbPath)
+		if srcErr == nil && localErr == nil {
+			return srcEpoch > localEpoch
+		}
+	}
+	return info.ModTime().After(local.ModTime())
+}
+
+// copyWithChecksum copies src to dst and returns the SHA256 hex digest.
+func copyWithChecksum(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
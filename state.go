@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// updateState is the update bookkeeping of a database. It is persisted next
+// to the database file, so update scheduling survives restarts and does not
+// depend on the file's modification time, which backups, copies and some
+// file systems do not keep.
+type updateState struct {
+	EditionID           string             `json:"edition_id"`
+	BuildEpoch          uint               `json:"build_epoch"`  // build of the file the state belongs to
+	LastAttempt         time.Time          `json:"last_attempt"` // latest update check, successful or not
+	LastCheck           time.Time          `json:"last_check"`   // latest check that reached upstream
+	LastDownload        time.Time          `json:"last_download"`
+	ConsecutiveFailures int                `json:"consecutive_failures"`
+	NextRetry           time.Time          `json:"next_retry"` // set after a failure that is retried early
+	LastError           string             `json:"last_error,omitempty"`
+	Validators          downloadValidators `json:"validators"`
+
+	// RolledBackBuildEpoch is the build replaced by the latest rollback. It
+	// is not installed again by regular updates, only by forced ones.
+	RolledBackBuildEpoch uint `json:"rolled_back_build_epoch,omitempty"`
+}
+
+// statePath returns the path of the state file kept for the database at dbPath.
+func statePath(dbPath string) string {
+	return dbPath + ".state.json"
+}
+
+// loadState reads the state file of the database at dbPath.
+func loadState(dbPath string) (updateState, error) {
+	var state updateState
+	data, err := os.ReadFile(statePath(dbPath))
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return updateState{}, fmt.Errorf("invalid state file %s: %w", statePath(dbPath), err)
+	}
+	return state, nil
+}
+
+// saveState writes the state file of the database at dbPath through a
+// temporary file, so readers never see a partial file.
+func saveState(dbPath string, state updateState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := statePath(dbPath)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), sharedFileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreState loads the persisted state of an entry on startup. State
+// written for another edition is ignored. State written for another build
+// than the file on disk, e.g. after the volume was restored from a backup,
+// keeps its failure count but schedules a check right away.
+func restoreState(entry *databaseEntry) {
+	state, err := loadState(entry.path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Debug("no update state, scheduling updates from the file's modification time", "database", entry.name)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to load update state", "database", entry.name, "error", err)
+		return
+	}
+	if state.EditionID != entry.editionID {
+		logger.Info("ignoring update state written for another edition", "database", entry.name, "edition", state.EditionID)
+		return
+	}
+	if buildEpoch, err := databaseBuildEpoch(entry.path); err == nil && buildEpoch != state.BuildEpoch {
+		logger.Info("database file does not match its update state, checking for updates", "database", entry.name, "path", entry.path,
+			"build_epoch", buildEpoch, "expected_build_epoch", state.BuildEpoch)
+		state.LastAttempt, state.LastCheck = time.Time{}, time.Time{}
+		state.NextRetry = time.Now()
+		state.Validators = downloadValidators{}
+		state.BuildEpoch = buildEpoch
+	}
+
+	entry.statusMu.Lock()
+	defer entry.statusMu.Unlock()
+	entry.state = state
+	entry.status.LastDownloadAt = state.LastAttempt
+	entry.status.LastDownloadError = state.LastError
+	entry.status.ConsecutiveFailures = state.ConsecutiveFailures
+}
+
+// persistState writes the entry's current state. Failures are logged, and
+// scheduling continues from the in-memory state.
+func (e *databaseEntry) persistState() {
+	e.statusMu.Lock()
+	e.state.EditionID = e.editionID
+	state := e.state
+	e.statusMu.Unlock()
+
+	if err := saveState(e.path, state); err != nil {
+		logger.Error("failed to save update state", "database", e.name, "error", err)
+	}
+}
+
+// updateDue returns when the entry should next be checked for updates: one
+// update interval after the latest attempt. Without a recorded attempt, e.g.
+// on the first run or with a file kept up to date by geoipupdate, the
+// file's modification time stands in for it, and a missing file is due
+// now. After a failed attempt, the retry scheduled by retryDelay comes first.
+func (e *databaseEntry) updateDue() time.Time {
+	e.statusMu.Lock()
+	lastAttempt, nextRetry := e.state.LastAttempt, e.state.NextRetry
+	e.statusMu.Unlock()
+
+	if lastAttempt.IsZero() {
+		info, err := os.Stat(e.path)
+		if err != nil {
+			return time.Now()
+		}
+		lastAttempt = info.ModTime()
+	}
+	due := lastAttempt.Add(time.Duration(e.updateInterval) * time.Hour)
+	if !nextRetry.IsZero() && nextRetry.Before(due) {
+		due = nextRetry
+	}
+	return due
+}
+
+// LastCheck returns when upstream was last successfully checked for updates.
+func (e *databaseEntry) LastCheck() time.Time {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.state.LastCheck
+}
+
+// rolledBackBuild returns the build epoch replaced by the latest rollback, or 0.
+func (e *databaseEntry) rolledBackBuild() uint {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.state.RolledBackBuildEpoch
+}
+
+// recordRollback remembers that build from was replaced by build to, so
+// updates do not install it again, and persists the state.
+func (e *databaseEntry) recordRollback(from, to uint) {
+	e.statusMu.Lock()
+	e.state.RolledBackBuildEpoch = from
+	e.state.BuildEpoch = to
+	e.statusMu.Unlock()
+
+	e.persistState()
+}
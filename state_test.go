@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateDue(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GeoLite2-City.mmdb")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	lastAttempt := time.Date(2026, 10, 10, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		path        string
+		lastAttempt time.Time
+		nextRetry   time.Time
+		want        time.Time // zero means now
+	}{
+		{
+			name:        "interval after the last attempt",
+			path:        path,
+			lastAttempt: lastAttempt,
+			want:        lastAttempt.Add(24 * time.Hour),
+		},
+		{
+			name:        "earlier retry comes first",
+			path:        path,
+			lastAttempt: lastAttempt,
+			nextRetry:   lastAttempt.Add(5 * time.Minute),
+			want:        lastAttempt.Add(5 * time.Minute),
+		},
+		{
+			name:        "later retry is ignored",
+			path:        path,
+			lastAttempt: lastAttempt,
+			nextRetry:   lastAttempt.Add(48 * time.Hour),
+			want:        lastAttempt.Add(24 * time.Hour),
+		},
+		{
+			name: "modification time without an attempt",
+			path: path,
+			want: modTime.Add(24 * time.Hour),
+		},
+		{
+			name:      "retry without an attempt",
+			path:      path,
+			nextRetry: modTime.Add(time.Hour),
+			want:      modTime.Add(time.Hour),
+		},
+		{
+			name: "missing file is due now",
+			path: filepath.Join(dir, "missing.mmdb"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &databaseEntry{name: "city", path: tt.path, updateInterval: 24}
+			entry.state.LastAttempt, entry.state.NextRetry = tt.lastAttempt, tt.nextRetry
+
+			before := time.Now()
+			got := entry.updateDue()
+			if tt.want.IsZero() {
+				if got.Before(before) || got.After(time.Now()) {
+					t.Errorf("updateDue() = %s, want now", got)
+				}
+			} else if !got.Equal(tt.want) {
+				t.Errorf("updateDue() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	fixture, err := os.ReadFile(diffOldFixture) // build epoch 1760400000
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastAttempt := time.Date(2026, 10, 10, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		state           *updateState
+		wantLastAttempt time.Time
+		wantFailures    int
+		wantRetryNow    bool
+	}{
+		{
+			name: "no state file",
+		},
+		{
+			name:            "matching build",
+			state:           &updateState{EditionID: "GeoLite2-Country", BuildEpoch: 1760400000, LastAttempt: lastAttempt, ConsecutiveFailures: 2},
+			wantLastAttempt: lastAttempt,
+			wantFailures:    2,
+		},
+		{
+			name:  "other edition",
+			state: &updateState{EditionID: "GeoLite2-City", BuildEpoch: 1760400000, LastAttempt: lastAttempt, ConsecutiveFailures: 2},
+		},
+		{
+			name:         "other build",
+			state:        &updateState{EditionID: "GeoLite2-Country", BuildEpoch: 1700000000, LastAttempt: lastAttempt, ConsecutiveFailures: 2},
+			wantFailures: 2,
+			wantRetryNow: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+			if err := os.WriteFile(path, fixture, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.state != nil {
+				if err := saveState(path, *tt.state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entry := &databaseEntry{name: "country", path: path, editionID: "GeoLite2-Country", updateInterval: 24}
+			before := time.Now()
+			restoreState(entry)
+
+			if !entry.state.LastAttempt.Equal(tt.wantLastAttempt) {
+				t.Errorf("LastAttempt = %s, want %s", entry.state.LastAttempt, tt.wantLastAttempt)
+			}
+			if entry.state.ConsecutiveFailures != tt.wantFailures {
+				t.Errorf("ConsecutiveFailures = %d, want %d", entry.state.ConsecutiveFailures, tt.wantFailures)
+			}
+			if due := entry.updateDue(); tt.wantRetryNow && (due.Before(before) || due.After(time.Now())) {
+				t.Errorf("updateDue() = %s, want now", due)
+			}
+			if tt.wantRetryNow && entry.state.BuildEpoch != 1760400000 {
+				t.Errorf("BuildEpoch = %d, want the build of the file", entry.state.BuildEpoch)
+			}
+		})
+	}
+}
+
+func TestSaveStateMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	if err := saveState(path, updateState{EditionID: "GeoLite2-City"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(statePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != sharedFileMode {
+		t.Errorf("state file mode = %v, want %v", info.Mode().Perm(), os.FileMode(sharedFileMode))
+	}
+}
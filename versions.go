@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// versionLayout is the build date format used in versioned file names,
+// e.g. GeoLite2-City.20261014.mmdb.
+const versionLayout = "20060102"
+
+// keepVersions is the number of previous database files kept next to each
+// database for rollbacks. Zero keeps none.
+var keepVersions int
+
+// databaseVersion is a previous build of a database kept on disk.
+type databaseVersion struct {
+	Version    string    `json:"version"`
+	Path       string    `json:"path"`
+	BuildEpoch uint      `json:"build_epoch"`
+	Size       int64     `json:"size"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// versionPath returns the versioned file name of a build of the database at dbPath.
+func versionPath(dbPath string, buildEpoch uint) string {
+	ext := filepath.Ext(dbPath)
+	base := strings.TrimSuffix(dbPath, ext)
+	return fmt.Sprintf("%s.%s%s", base, time.Unix(int64(buildEpoch), 0).UTC().Format(versionLayout), ext)
+}
+
+// databaseBuildEpoch reads the build epoch from an MMDB file's metadata.
+func databaseBuildEpoch(path string) (uint, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return reader.Metadata.BuildEpoch, nil
+}
+
+// listVersions returns the versioned files kept for the database at dbPath,
+// newest build first. Files that cannot be opened are skipped.
+func listVersions(dbPath string) ([]databaseVersion, error) {
+	ext := filepath.Ext(dbPath)
+	base := strings.TrimSuffix(dbPath, ext)
+	matches, err := filepath.Glob(globEscape(base) + ".*" + globEscape(ext))
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []databaseVersion
+	for _, path := range matches {
+		version := strings.TrimSuffix(strings.TrimPrefix(path, base+"."), ext)
+		if _, err := time.Parse(versionLayout, version); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		buildEpoch, err := databaseBuildEpoch(path)
+		if err != nil {
+			logger.Debug("skipping unreadable database version", "path", path, "error", err)
+			continue
+		}
+		versions = append(versions, databaseVersion{
+			Version:    version,
+			Path:       path,
+			BuildEpoch: buildEpoch,
+			Size:       info.Size(),
+			ArchivedAt: info.ModTime(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].BuildEpoch > versions[j].BuildEpoch
+	})
+	return versions, nil
+}
+
+// globEscape escapes the glob metacharacters of a literal path.
+func globEscape(path string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return replacer.Replace(path)
+}
+
+// archiveDatabase keeps a versioned copy of the file at dbPath before it is
+// replaced, and removes the oldest versions beyond keepVersions.
+func archiveDatabase(dbPath string) error {
+	if err := keepVersion(dbPath); err != nil {
+		return err
+	}
+	pruneVersions(dbPath)
+	return nil
+}
+
+// keepVersion stores a versioned copy of the file at dbPath. The copy is a
+// hard link where possible, so it costs no extra disk space until dbPath is
+// replaced.
+func keepVersion(dbPath string) error {
+	if keepVersions <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	buildEpoch, err := databaseBuildEpoch(dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to read build epoch of %s: %w", dbPath, err)
+	}
+	archivePath := versionPath(dbPath, buildEpoch)
+	if _, err := os.Stat(archivePath); err == nil {
+		logger.Debug("database version already kept", "path", archivePath)
+		return nil
+	}
+	if err := os.Link(dbPath, archivePath); err != nil {
+		logger.Debug("cannot hard link database version, copying instead", "path", archivePath, "error", err)
+		if err := copyFile(dbPath, archivePath); err != nil {
+			return fmt.Errorf("failed to keep version %s: %w", archivePath, err)
+		}
+	}
+	logger.Info("kept previous database version", "path", archivePath)
+	return nil
+}
+
+// pruneVersions removes the oldest versions of dbPath beyond keepVersions.
+func pruneVersions(dbPath string) {
+	versions, err := listVersions(dbPath)
+	if err != nil {
+		logger.Error("failed to list database versions", "path", dbPath, "error", err)
+		return
+	}
+	for i := keepVersions; i < len(versions); i++ {
+		if err := os.Remove(versions[i].Path); err != nil {
+			logger.Error("failed to remove old database version", "path", versions[i].Path, "error", err)
+			continue
+		}
+		logger.Info("removed old database version", "path", versions[i].Path)
+	}
+}
+
+// copyFile copies src to dst through a temporary file in dst's directory, so
+// dst is replaced atomically. dst gets the permissions of src.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// CreateTemp creates files readable by the owner only
+	if err := os.Chmod(out.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// errVersionNotFound is returned by rollbackDatabase when no kept version
+// matches the request.
+var errVersionNotFound = errors.New("version not found")
+
+// rollbackDatabase restores a kept version of the entry's database and
+// reloads it. Without a version, the newest build older than the loaded one
+// is restored. The replaced file is kept as a version too, so a rollback can
+// be undone. A build replaced by an older one is not installed again until
+// a forced update. The caller must hold entry.updateMu.
+func rollbackDatabase(entry *databaseEntry, version string) (databaseVersion, error) {
+	versions, err := listVersions(entry.path)
+	if err != nil {
+		return databaseVersion{}, err
+	}
+
+	currentEpoch, _ := entry.describe()
+	var target *databaseVersion
+	for i := range versions {
+		if (version == "" && versions[i].BuildEpoch < currentEpoch) || (version != "" && versions[i].Version == version) {
+			target = &versions[i]
+			break
+		}
+	}
+	if target == nil {
+		if version == "" {
+			return databaseVersion{}, fmt.Errorf("%w: no kept version of %s is older than the loaded build", errVersionNotFound, entry.name)
+		}
+		return databaseVersion{}, fmt.Errorf("%w: no kept version %s of %s", errVersionNotFound, version, entry.name)
+	}
+
+	if err := keepVersion(entry.path); err != nil {
+		logger.Error("failed to keep the current version before rollback", "database", entry.name, "error", err)
+	}
+	if err := copyFile(target.Path, entry.path); err != nil {
+		return databaseVersion{}, fmt.Errorf("failed to restore %s: %w", target.Path, err)
+	}
+	if err := reloadDatabase(entry); err != nil {
+		return databaseVersion{}, err
+	}
+	pruneVersions(entry.path)
+	if currentEpoch > target.BuildEpoch {
+		entry.recordRollback(currentEpoch, target.BuildEpoch)
+	}
+
+	logger.Warn("database rolled back", "database", entry.name, "version", target.Version, "build_epoch", target.BuildEpoch)
+	return *target, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackIsNotReinstalled(t *testing.T) {
+	defer func(keep int, verify bool) { keepVersions, verifyChecksums = keep, verify }(keepVersions, verifyChecksums)
+	keepVersions, verifyChecksums = 2, false
+
+	const oldBuild, newBuild = 1760400000, 1760500000
+	oldFixture, err := os.ReadFile(diffOldFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFixture, err := os.ReadFile(diffNewFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upstream announces the new build the way MaxMind does
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="GeoLite2-Country_20251015.tar.gz"`)
+		w.Write(newFixture)
+	}))
+	defer server.Close()
+	source := newMirrorSource(server.URL + "/{edition}.tar.gz")
+
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	if err := os.WriteFile(path, oldFixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := &databaseEntry{name: "country", path: path, editionID: "GeoLite2-Country", updateInterval: 24}
+	if err := reloadDatabase(entry); err != nil {
+		t.Fatal(err)
+	}
+	defer entry.close()
+
+	steps := []struct {
+		name      string
+		run       func() error
+		wantBuild uint
+		wantSkip  uint
+	}{
+		{"update installs the new build", func() error { return updateDatabase(source, entry, false) }, newBuild, 0},
+		{"rollback", func() error { _, err := rollbackDatabase(entry, ""); return err }, oldBuild, newBuild},
+		{"update skips the rolled back build", func() error { return updateDatabase(source, entry, false) }, oldBuild, newBuild},
+		{"forced update installs it again", func() error { return updateDatabase(source, entry, true) }, newBuild, 0},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: error = %v", step.name, err)
+		}
+		if build, _ := entry.describe(); build != step.wantBuild {
+			t.Errorf("%s: loaded build = %d, want %d", step.name, build, step.wantBuild)
+		}
+		if skip := entry.rolledBackBuild(); skip != step.wantSkip {
+			t.Errorf("%s: rolled back build = %d, want %d", step.name, skip, step.wantSkip)
+		}
+	}
+
+	// The skipped build survives a restart
+	restarted := &databaseEntry{name: "country", path: path, editionID: "GeoLite2-Country", updateInterval: 24}
+	if _, err := rollbackDatabase(entry, ""); err != nil {
+		t.Fatal(err)
+	}
+	restoreState(restarted)
+	if skip := restarted.rolledBackBuild(); skip != newBuild {
+		t.Errorf("rolled back build after restart = %d, want %d", skip, newBuild)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloadAllDatabases reopens every registered database from disk. A database
+// that fails to load keeps serving its previous version.
+func reloadAllDatabases(reason string) {
+	for _, entry := range registry.all() {
+		entry.updateMu.Lock()
+		err := reloadDatabase(entry)
+		entry.updateMu.Unlock()
+		if err != nil {
+			logger.Error("database reload failed", "database", entry.name, "path", entry.path, "reason", reason, "error", err)
+		}
+	}
+}
+
+// handleReloadSignals reloads all databases whenever the process receives SIGHUP,
+// so an external updater can signal that it replaced the files.
+func handleReloadSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		logger.Info("SIGHUP received, reloading databases")
+		reloadAllDatabases("SIGHUP")
+	}
+}
+
+// sameFileVersion reports whether two stats describe the same, unmodified file.
+// Replacing a file by rename (or swapping a ConfigMap symlink) changes its
+// identity; rewriting it in place changes its size or modification time.
+func sameFileVersion(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// watchDatabaseFiles polls the database files every interval and reloads
+// those that were replaced since they were loaded. A changed file is only
+// reloaded once it looks the same on two consecutive polls, so a file that
+// is still being written is not picked up half-way. A version that fails to
+// load is not retried until it changes again.
+func watchDatabaseFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger.Info("watching database files for changes", "interval", interval)
+
+	pending := make(map[*databaseEntry]os.FileInfo)
+	failed := make(map[*databaseEntry]os.FileInfo)
+
+	for range ticker.C {
+		for _, entry := range registry.all() {
+			info, err := os.Stat(entry.path)
+			if err != nil {
+				logger.Debug("cannot stat database file", "database", entry.name, "path", entry.path, "error", err)
+				delete(pending, entry)
+				continue
+			}
+
+			if loaded := entry.LoadedFile(); loaded != nil && sameFileVersion(info, loaded) {
+				delete(pending, entry)
+				continue
+			}
+			if last, ok := failed[entry]; ok && sameFileVersion(info, last) {
+				continue
+			}
+			if last, ok := pending[entry]; !ok || !sameFileVersion(info, last) {
+				logger.Debug("database file changed, waiting for it to settle", "database", entry.name, "path", entry.path)
+				pending[entry] = info
+				continue
+			}
+
+			delete(pending, entry)
+			logger.Info("database file replaced, reloading", "database", entry.name, "path", entry.path)
+			entry.updateMu.Lock()
+			err = reloadDatabase(entry)
+			entry.updateMu.Unlock()
+			if err != nil {
+				logger.Error("database reload failed", "database", entry.name, "path", entry.path, "reason", "file changed", "error", err)
+				failed[entry] = info
+				continue
+			}
+			delete(failed, entry)
+		}
+	}
+}